@@ -3,11 +3,22 @@ package event
 // Option configuration
 type Option func(map[string]interface{})
 
-// Severity sets the event 'severity' annotation
-func Severity(severity string) Option {
+// SeverityLevel is the value of the event 'severity' annotation
+type SeverityLevel string
+
+// Known event severity levels
+const (
+	SeverityInfo   SeverityLevel = "info"
+	SeverityWarn   SeverityLevel = "warn"
+	SeveritySevere SeverityLevel = "severe"
+)
+
+// Severity sets the event 'severity' annotation.
+// Events with a severity other than SeverityInfo, SeverityWarn or SeveritySevere are rejected
+func Severity(severity SeverityLevel) Option {
 	return func(event map[string]interface{}) {
 		annotations := event["annotations"].(map[string]string)
-		annotations["severity"] = severity
+		annotations["severity"] = string(severity)
 	}
 }
 
@@ -34,3 +45,15 @@ func Annotate(key, value string) Option {
 		annotations[key] = value
 	}
 }
+
+// StructuredTagsKey marks an event whose tag keys are escaped, see StructuredTags
+const StructuredTagsKey = "structuredTags"
+
+// StructuredTags escapes '\' and ':' in tag keys with a backslash, so tags written as
+// "key: value" can be split back with senders.SplitEventTag even when the key or the value
+// contains ": ". Keys without these characters are written as without the option.
+func StructuredTags() Option {
+	return func(event map[string]interface{}) {
+		event[StructuredTagsKey] = true
+	}
+}
@@ -68,7 +68,7 @@ func main() {
 	tags["namespace"] = "default"
 	tags["Kind"] = "Deployment"
 
-	options := []event.Option{event.Details("Details"), event.Type("type"), event.Severity("severity")}
+	options := []event.Option{event.Details("Details"), event.Type("type"), event.Severity(event.SeverityInfo)}
 
 	for i := 0; i < 10; i++ {
 		err := wf.SendMetric("sample.metric", float64(i), time.Now().UnixNano(), source, map[string]string{"env": "test"})
@@ -1,7 +1,9 @@
 package histogram
 
 import (
+	"math"
 	"math/rand"
+	"os"
 	"sort"
 	"testing"
 	"time"
@@ -67,6 +69,175 @@ func TestCompactHistoLine(t *testing.T) {
 	assert.Equal(t, centroidsExp, vals, "Error on Centroids.Compact()")
 }
 
-func (a Centroids) Len() int           { return len(a) }
-func (a Centroids) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
-func (a Centroids) Less(i, j int) bool { return a[i].Value < a[j].Value }
+func TestCompactContract(t *testing.T) {
+	centroids := Centroids{
+		{Value: 30.0, Count: 20},
+		{Value: -1, Count: 0},
+		{Value: 5.1, Count: 10},
+		{Value: 30.0, Count: 5},
+	}
+	compacted := centroids.Compact()
+	assert.Equal(t, Centroids{{Value: -1, Count: 0}, {Value: 5.1, Count: 10}, {Value: 30.0, Count: 25}}, compacted)
+	assert.Equal(t, compacted, compacted.Compact(), "Compact must be idempotent")
+	assert.Equal(t, 4, centroids.Len(), "the input is not modified")
+	assert.Equal(t, Centroid{Value: 30.0, Count: 20}, centroids[0])
+
+	assert.Equal(t, Centroids{}, Centroids{}.Compact())
+	assert.Equal(t, Centroids{}, Centroids(nil).Compact())
+	assert.Equal(t, 0, Centroids(nil).Len())
+}
+
+func TestCentroidsSort(t *testing.T) {
+	centroids := Centroids{{Value: 30.0, Count: 20}, {Value: 5.1, Count: 10}, {Value: 30.0, Count: 2}, {Value: -1, Count: 1}}
+	centroids.Sort()
+	assert.Equal(t, Centroids{{Value: -1, Count: 1}, {Value: 5.1, Count: 10}, {Value: 30.0, Count: 2}, {Value: 30.0, Count: 20}}, centroids)
+
+	reversed := Centroids{{Value: 30.0, Count: 20}, {Value: 30.0, Count: 2}, {Value: 5.1, Count: 10}, {Value: -1, Count: 1}}
+	reversed.Sort()
+	assert.Equal(t, centroids, reversed)
+
+	Centroids(nil).Sort()
+}
+
+func TestCentroidsMerge(t *testing.T) {
+	assert.Equal(t, Centroids{}, Centroids{}.Merge(nil))
+
+	single := Centroids{{Value: 3.2, Count: 5}}
+	assert.Equal(t, single, single.Merge(nil))
+	assert.Equal(t, single, Centroids{}.Merge(single))
+
+	a := Centroids{{Value: 30.0, Count: 20}, {Value: 5.1, Count: 10}}
+	b := Centroids{{Value: 5.1, Count: 1}, {Value: 30.0, Count: 2}}
+	assert.Equal(t, Centroids{{Value: 5.1, Count: 11}, {Value: 30.0, Count: 22}}, a.Merge(b))
+	assert.Equal(t, Centroids{{Value: 30.0, Count: 20}, {Value: 5.1, Count: 10}}, a, "receiver must not be modified")
+
+	c := Centroids{{Value: 1, Count: 1}, {Value: 30.0, Count: 2}}
+	assert.Equal(t, Centroids{{Value: 1, Count: 1}, {Value: 5.1, Count: 10}, {Value: 30.0, Count: 22}}, a.Merge(c))
+}
+
+func TestCentroidsFromMap(t *testing.T) {
+	centroids, err := CentroidsFromMap(map[float64]int{30: 20, 5.1: 10, -1: 0, 12.5: 3})
+	assert.Nil(t, err)
+	assert.Equal(t, Centroids{{Value: 5.1, Count: 10}, {Value: 12.5, Count: 3}, {Value: 30, Count: 20}}, centroids)
+
+	centroids, err = CentroidsFromMap(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(centroids))
+
+	_, err = CentroidsFromMap(map[float64]int{5.1: 10, 3: -1})
+	assert.EqualError(t, err, "centroid 3 has a negative count: -1")
+	_, err = CentroidsFromMap(map[float64]int{math.NaN(): 1})
+	assert.NotNil(t, err)
+	_, err = CentroidsFromMap(map[float64]int{math.Inf(1): 1})
+	assert.NotNil(t, err)
+}
+
+func TestCentroidsFromBuckets(t *testing.T) {
+	centroids, err := CentroidsFromBuckets([]float64{1, 2, 4, math.Inf(1)}, []uint64{3, 0, 5, 2})
+	assert.Nil(t, err)
+	assert.Equal(t, Centroids{{Value: 1, Count: 3}, {Value: 3, Count: 5}, {Value: 4, Count: 2}}, centroids)
+
+	centroids, err = CentroidsFromBuckets(nil, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(centroids))
+
+	_, err = CentroidsFromBuckets([]float64{1, 2}, []uint64{1})
+	assert.NotNil(t, err)
+	_, err = CentroidsFromBuckets([]float64{2, 1}, []uint64{1, 1})
+	assert.NotNil(t, err)
+	_, err = CentroidsFromBuckets([]float64{1, math.Inf(1), 3}, []uint64{1, 1, 1})
+	assert.NotNil(t, err)
+	_, err = CentroidsFromBuckets([]float64{math.Inf(1)}, []uint64{1})
+	assert.NotNil(t, err)
+	_, err = CentroidsFromBuckets([]float64{math.NaN()}, []uint64{1})
+	assert.NotNil(t, err)
+}
+
+func TestCentroidsValidate(t *testing.T) {
+	assert.Nil(t, Centroids{}.Validate())
+	assert.Nil(t, Centroids{{Value: 3.2, Count: 5}, {Value: -1, Count: 1}}.Validate())
+	assert.EqualError(t, Centroids{{Value: 3.2, Count: 5}, {Value: -1, Count: 0}}.Validate(),
+		"centroid 1 has a zero count")
+
+	assert.EqualError(t, Centroids{{Value: 3.2, Count: 5}, {Value: 3.2, Count: -5}}.Validate(),
+		"centroid 1 has a negative count: -5")
+	assert.EqualError(t, Centroids{{Value: math.NaN(), Count: 5}}.Validate(), "centroid 0 has a NaN value")
+	assert.EqualError(t, Centroids{{Value: math.Inf(-1), Count: 5}}.Validate(), "centroid 0 has an infinite value")
+}
+
+func TestCentroidsPercentile(t *testing.T) {
+	centroids := Centroids{{Value: 30, Count: 10}, {Value: 10, Count: 10}, {Value: 20, Count: 0}}
+	assert.Equal(t, uint64(20), centroids.Count())
+	assert.Equal(t, 10.0, centroids.Percentile(0))
+	assert.Equal(t, 10.0, centroids.Percentile(25))
+	assert.Equal(t, 20.0, centroids.Percentile(50))
+	assert.Equal(t, 30.0, centroids.Percentile(75))
+	assert.Equal(t, 30.0, centroids.Percentile(100))
+
+	single := Centroids{{Value: 5.5, Count: 3}}
+	assert.Equal(t, 5.5, single.Percentile(99))
+
+	assert.True(t, math.IsNaN(centroids.Percentile(101)))
+	assert.True(t, math.IsNaN(centroids.Percentile(math.NaN())))
+	assert.True(t, math.IsNaN(Centroids{}.Percentile(50)))
+	assert.Equal(t, uint64(0), Centroids{}.Count())
+}
+
+func TestParseGranularity(t *testing.T) {
+	for s, expected := range map[string]Granularity{
+		"minute": MINUTE, "m": MINUTE, "Hour": HOUR, "H": HOUR, " day ": DAY, "d": DAY,
+	} {
+		hg, err := ParseGranularity(s)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, hg, s)
+	}
+
+	_, err := ParseGranularity("week")
+	assert.EqualError(t, err, `unknown histogram granularity "week", expected minute, hour or day`)
+	_, err = ParseGranularity("")
+	assert.NotNil(t, err)
+}
+
+func TestGranularitiesFromEnv(t *testing.T) {
+	const key = "WF_TEST_HISTO_GRANULARITIES"
+	defer os.Unsetenv(key)
+
+	os.Setenv(key, "minute, Hour,")
+	hgs, err := GranularitiesFromEnv(key)
+	assert.Nil(t, err)
+	assert.Equal(t, map[Granularity]bool{MINUTE: true, HOUR: true}, hgs)
+
+	os.Setenv(key, "m,week")
+	_, err = GranularitiesFromEnv(key)
+	assert.EqualError(t, err, key+`: unknown histogram granularity "week", expected minute, hour or day`)
+
+	os.Unsetenv(key)
+	hgs, err = GranularitiesFromEnv(key)
+	assert.Nil(t, err)
+	assert.Empty(t, hgs)
+}
+
+func TestCentroidsFromSamples(t *testing.T) {
+	assert.Equal(t, Centroids{}, CentroidsFromSamples(nil, 10))
+
+	samples := []float64{10, 1, 9, 2, 8, 3, 7, 4, 6, 5}
+	assert.Equal(t, Centroids{{Value: 2, Count: 3}, {Value: 5, Count: 3}, {Value: 8.5, Count: 4}}, CentroidsFromSamples(samples, 3))
+	assert.Equal(t, 10.0, samples[0], "samples must not be modified")
+
+	assert.Equal(t, Centroids{{Value: 5.5, Count: 10}}, CentroidsFromSamples(samples, 0))
+	assert.Len(t, CentroidsFromSamples(samples, 100), 10)
+	assert.Equal(t, Centroids{{Value: 1, Count: 1}}, CentroidsFromSamples([]float64{math.NaN(), 1}, 5))
+	assert.Equal(t, Centroids{{Value: 1, Count: 1}}, CentroidsFromSamples([]float64{math.Inf(1), 1, math.Inf(-1)}, 1))
+	assert.Equal(t, Centroids{{Value: math.MaxFloat64, Count: 2}}, CentroidsFromSamples([]float64{math.MaxFloat64, math.MaxFloat64}, 1))
+	assert.Equal(t, Centroids{{Value: -math.MaxFloat64, Count: 3}}, CentroidsFromSamples([]float64{-math.MaxFloat64, -math.MaxFloat64, -math.MaxFloat64}, 1))
+	assert.Nil(t, CentroidsFromSamples([]float64{math.MaxFloat64, math.MaxFloat64 / 2, -math.MaxFloat64}, 1).Validate())
+
+	large := make([]float64, 10000)
+	for i := range large {
+		large[i] = float64(i)
+	}
+	centroids := CentroidsFromSamples(large, 100)
+	assert.Len(t, centroids, 100)
+	assert.Equal(t, uint64(10000), centroids.Count())
+	assert.InDelta(t, 5000, centroids.Percentile(50), 100)
+}
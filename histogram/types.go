@@ -1,6 +1,12 @@
 package histogram
 
 import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
 	"time"
 )
 
@@ -12,6 +18,31 @@ type Centroid struct {
 
 type Centroids []Centroid
 
+// Len returns the number of centroids, before any compaction.
+func (centroids Centroids) Len() int { return len(centroids) }
+
+// Swap swaps the centroids at i and j, see sort.Interface.
+func (centroids Centroids) Swap(i, j int) { centroids[i], centroids[j] = centroids[j], centroids[i] }
+
+// Less orders centroids by value, see sort.Interface.
+func (centroids Centroids) Less(i, j int) bool { return centroids[i].Value < centroids[j].Value }
+
+// Sort sorts the centroids in place by value in ascending order, then by count for equal
+// values, so centroids given in any order end up in the same order.
+func (centroids Centroids) Sort() {
+	sort.SliceStable(centroids, func(i, j int) bool {
+		if centroids[i].Value != centroids[j].Value {
+			return centroids[i].Value < centroids[j].Value
+		}
+		return centroids[i].Count < centroids[j].Count
+	})
+}
+
+// Compact returns new centroids with the counts of centroids with equal values summed,
+// sorted by value in ascending order. Centroids with a zero count are kept.
+// As values are unique once compacted, the order is the same as that of Sort, whatever the
+// order of the input, which makes histogram lines deterministic.
+// The result of Compact is already compact: compacting it again gives the same centroids.
 func (centroids Centroids) Compact() Centroids {
 	tmp := make(map[float64]int)
 	for _, c := range centroids {
@@ -27,9 +58,201 @@ func (centroids Centroids) Compact() Centroids {
 		res[idx] = Centroid{Value: v, Count: c}
 		idx++
 	}
+	sort.Sort(res)
 	return res
 }
 
+// Merge returns the centroids of both sets, summing the counts of centroids with equal values.
+// The result is sorted by value in ascending order. Neither set is modified.
+func (centroids Centroids) Merge(other Centroids) Centroids {
+	all := make(Centroids, 0, len(centroids)+len(other))
+	all = append(all, centroids...)
+	all = append(all, other...)
+	return all.Compact()
+}
+
+// Validate returns an error if a centroid has a negative or zero count or a NaN or infinite
+// value. A centroid without points would poison the aggregation of the distribution.
+func (centroids Centroids) Validate() error {
+	for i, c := range centroids {
+		if c.Count < 0 {
+			return fmt.Errorf("centroid %d has a negative count: %d", i, c.Count)
+		}
+		if c.Count == 0 {
+			return fmt.Errorf("centroid %d has a zero count", i)
+		}
+		if math.IsNaN(c.Value) {
+			return fmt.Errorf("centroid %d has a NaN value", i)
+		}
+		if math.IsInf(c.Value, 0) {
+			return fmt.Errorf("centroid %d has an infinite value", i)
+		}
+	}
+	return nil
+}
+
+// Count returns the total number of points of the centroids. Centroids with a negative
+// count, which Validate rejects, are not counted.
+func (centroids Centroids) Count() uint64 {
+	var count uint64
+	for _, c := range centroids {
+		if c.Count > 0 {
+			count += uint64(c.Count)
+		}
+	}
+	return count
+}
+
+// Percentile returns an approximation of the p-th percentile, with p between 0 and 100,
+// of the points the centroids were built from. The points of each centroid are assumed to
+// be centered on its value and the percentile is interpolated between neighbouring centroids.
+// NaN is returned when p is out of range or there are no points.
+func (centroids Centroids) Percentile(p float64) float64 {
+	if !(p >= 0 && p <= 100) {
+		return math.NaN()
+	}
+
+	sorted := make(Centroids, 0, len(centroids))
+	for _, c := range centroids {
+		if c.Count > 0 {
+			sorted = append(sorted, c)
+		}
+	}
+	if len(sorted) == 0 {
+		return math.NaN()
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Value < sorted[j].Value
+	})
+
+	target := p / 100 * float64(sorted.Count())
+	var cumulative, prevCenter float64
+	for i, c := range sorted {
+		center := cumulative + float64(c.Count)/2
+		if target <= center {
+			if i == 0 {
+				return c.Value
+			}
+			prev := sorted[i-1].Value
+			return prev + (c.Value-prev)*(target-prevCenter)/(center-prevCenter)
+		}
+		cumulative += float64(c.Count)
+		prevCenter = center
+	}
+	return sorted[len(sorted)-1].Value
+}
+
+// CentroidsFromMap converts counts keyed by value into centroids sorted by value in ascending
+// order, so the same map always gives the same centroids. Values must be finite and counts
+// must not be negative. Values with a zero count are dropped, as Validate rejects them.
+func CentroidsFromMap(m map[float64]int) (Centroids, error) {
+	centroids := make(Centroids, 0, len(m))
+	for v, c := range m {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return nil, fmt.Errorf("invalid centroid value: %v", v)
+		}
+		if c < 0 {
+			return nil, fmt.Errorf("centroid %v has a negative count: %d", v, c)
+		}
+		if c == 0 {
+			continue
+		}
+		centroids = append(centroids, Centroid{Value: v, Count: c})
+	}
+	sort.Sort(centroids)
+	return centroids, nil
+}
+
+// CentroidsFromBuckets converts a pre-binned distribution into centroids. bounds holds the
+// increasing upper bound of each bucket and counts the number of points in each bucket
+// (not cumulative). Each bucket becomes a centroid at the midpoint of its lower and upper bound,
+// so the values are an approximation of the original points. The first bucket has no lower
+// bound and is placed at its upper bound, a final +Inf bucket is placed at its lower bound.
+// Empty buckets are skipped.
+func CentroidsFromBuckets(bounds []float64, counts []uint64) (Centroids, error) {
+	if len(bounds) != len(counts) {
+		return nil, fmt.Errorf("bounds and counts differ in length: %d != %d", len(bounds), len(counts))
+	}
+
+	centroids := make(Centroids, 0, len(bounds))
+	for i, upper := range bounds {
+		if math.IsNaN(upper) || math.IsInf(upper, -1) || (math.IsInf(upper, 1) && i != len(bounds)-1) {
+			return nil, fmt.Errorf("invalid bucket bound %d: %v", i, upper)
+		}
+		if i > 0 && upper <= bounds[i-1] {
+			return nil, fmt.Errorf("bucket bounds must be increasing: %v <= %v", upper, bounds[i-1])
+		}
+
+		count := int(counts[i])
+		if count < 0 || uint64(count) != counts[i] {
+			return nil, fmt.Errorf("bucket %d count overflows: %d", i, counts[i])
+		}
+		if count == 0 {
+			continue
+		}
+
+		var value float64
+		switch {
+		case math.IsInf(upper, 1):
+			if i == 0 {
+				return nil, errors.New("a +Inf bucket needs a finite bucket before it")
+			}
+			value = bounds[i-1]
+		case i == 0:
+			value = upper
+		default:
+			value = bounds[i-1] + (upper-bounds[i-1])/2
+		}
+		centroids = append(centroids, Centroid{Value: value, Count: count})
+	}
+	return centroids, nil
+}
+
+// CentroidsFromSamples bins raw samples into at most maxCentroids centroids of (nearly) equal
+// count, each at the mean of the samples it holds. This is simpler than a t-digest and keeps the
+// same relative accuracy across the distribution, so the extreme percentiles are only as precise
+// as the bins at the tails: more centroids give more accurate percentiles at the cost of a longer
+// line. The samples do not need to be sorted and are not modified. NaN and infinite samples are
+// ignored, as no line can carry them, and a maxCentroids below 1 is taken as 1. Empty input gives
+// empty Centroids.
+func CentroidsFromSamples(samples []float64, maxCentroids int) Centroids {
+	sorted := make([]float64, 0, len(samples))
+	for _, v := range samples {
+		if !math.IsNaN(v) && !math.IsInf(v, 0) {
+			sorted = append(sorted, v)
+		}
+	}
+	if len(sorted) == 0 {
+		return Centroids{}
+	}
+	sort.Float64s(sorted)
+
+	bins := maxCentroids
+	if bins < 1 {
+		bins = 1
+	}
+	if bins > len(sorted) {
+		bins = len(sorted)
+	}
+
+	centroids := make(Centroids, 0, bins)
+	start := 0
+	for i := 1; i <= bins; i++ {
+		// spread the remainder so bin sizes differ by at most one
+		end := i * len(sorted) / bins
+		// a running mean, as a sum of large samples can overflow. Dividing before subtracting
+		// keeps v-mean from overflowing too when they are far apart.
+		var mean float64
+		for n, v := range sorted[start:end] {
+			k := float64(n + 1)
+			mean += v/k - mean/k
+		}
+		centroids = append(centroids, Centroid{Value: mean, Count: end - start})
+		start = end
+	}
+	return centroids
+}
+
 // Granularity is the interval (MINUTE, HOUR and/or DAY) by which the histogram data should be aggregated.
 type Granularity int8
 
@@ -39,6 +262,48 @@ const (
 	DAY
 )
 
+// ParseGranularity parses a granularity from its name, one of "minute", "hour" or "day",
+// or the short form "m", "h" or "d". Case is ignored.
+func ParseGranularity(s string) (Granularity, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "minute", "m":
+		return MINUTE, nil
+	case "hour", "h":
+		return HOUR, nil
+	case "day", "d":
+		return DAY, nil
+	}
+	return 0, fmt.Errorf("unknown histogram granularity %q, expected minute, hour or day", s)
+}
+
+// ParseGranularities parses a comma-separated list of granularities, such as "minute,hour",
+// each as by ParseGranularity, into the map HistoLine expects. Blank items are skipped.
+func ParseGranularities(s string) (map[Granularity]bool, error) {
+	hgs := make(map[Granularity]bool)
+	for _, item := range strings.Split(s, ",") {
+		if strings.TrimSpace(item) == "" {
+			continue
+		}
+		hg, err := ParseGranularity(item)
+		if err != nil {
+			return nil, err
+		}
+		hgs[hg] = true
+	}
+	return hgs, nil
+}
+
+// GranularitiesFromEnv parses the granularities listed in the environment variable key, such
+// as WF_HISTO_GRANULARITIES=minute,hour, with ParseGranularities. An unset or empty variable
+// gives an empty map, so the caller can fall back to its default.
+func GranularitiesFromEnv(key string) (map[Granularity]bool, error) {
+	hgs, err := ParseGranularities(os.Getenv(key))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", key, err)
+	}
+	return hgs, nil
+}
+
 // Duration of the Granularity
 func (hg *Granularity) Duration() time.Duration {
 	switch *hg {
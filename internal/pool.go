@@ -2,25 +2,49 @@ package internal
 
 import (
 	"sync"
+	"sync/atomic"
 )
 
+// maxPooledBufferCap is the capacity beyond which a buffer is not returned to the pool,
+// so a single huge line does not keep its memory alive for the life of the process.
+const maxPooledBufferCap = 64 * 1024
+
 var buffers *sync.Pool
 
+// pool counters, updated atomically, see PoolStats
+var poolGets, poolPuts, poolMisses uint64
+
 func init() {
 	buffers = &sync.Pool{
 		New: func() interface{} {
+			atomic.AddUint64(&poolMisses, 1)
 			return new(StringBuilder)
 		},
 	}
 }
 
+// PoolStats returns the number of buffers fetched with GetBuffer, returned to the pool with
+// PutBuffer and allocated because the pool was empty, since the process started.
+// Oversized buffers discarded by PutBuffer are not counted as puts. Misses growing with gets
+// mean the pool is too small for the concurrency, or its buffers are collected between uses.
+func PoolStats() (gets, puts, misses uint64) {
+	return atomic.LoadUint64(&poolGets), atomic.LoadUint64(&poolPuts), atomic.LoadUint64(&poolMisses)
+}
+
 // GetBuffer fetches a buffers from the pool
 func GetBuffer() *StringBuilder {
+	atomic.AddUint64(&poolGets, 1)
 	return buffers.Get().(*StringBuilder)
 }
 
-// PutBuffer returns a buffers to the pool
+// PutBuffer returns a buffers to the pool.
+// The buffer is emptied with Reset, which keeps its capacity, so the memory is reused by the
+// next GetBuffer. Buffers grown beyond maxPooledBufferCap are discarded.
 func PutBuffer(buf *StringBuilder) {
+	if buf.Cap() > maxPooledBufferCap {
+		return
+	}
 	buf.Reset()
+	atomic.AddUint64(&poolPuts, 1)
 	buffers.Put(buf)
 }
@@ -0,0 +1,53 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPutBufferDiscardsLargeBuffers(t *testing.T) {
+	buf := GetBuffer()
+	buf.Grow(maxPooledBufferCap + 1)
+	PutBuffer(buf)
+
+	for i := 0; i < 10; i++ {
+		got := GetBuffer()
+		assert.True(t, got != buf, "oversized buffer was returned to the pool")
+		assert.True(t, got.Cap() <= maxPooledBufferCap)
+		defer PutBuffer(got)
+	}
+}
+
+func TestPutBufferKeepsCapacity(t *testing.T) {
+	buf := new(StringBuilder)
+	buf.Grow(maxPooledBufferCap)
+	buf.WriteString("hello")
+	capacity := buf.Cap()
+	PutBuffer(buf)
+
+	// the pool may drop the buffer, so check the buffer itself rather than what Get returns
+	assert.Equal(t, 0, buf.Len())
+	assert.Equal(t, capacity, buf.Cap())
+	assert.True(t, capacity >= maxPooledBufferCap)
+
+	buf.WriteString("reused")
+	assert.Equal(t, "reused", string(buf.GetBuf()))
+	assert.Equal(t, capacity, buf.Cap())
+}
+
+func TestPoolStats(t *testing.T) {
+	gets, puts, misses := PoolStats()
+
+	buf := GetBuffer()
+	PutBuffer(buf)
+	large := GetBuffer()
+	large.Grow(maxPooledBufferCap + 1)
+	PutBuffer(large)
+
+	// the pool may drop buffers at any time, so misses can only be bounded
+	gets2, puts2, misses2 := PoolStats()
+	assert.Equal(t, gets+2, gets2)
+	assert.Equal(t, puts+1, puts2)
+	assert.True(t, misses2 >= misses && misses2 <= misses+2)
+}
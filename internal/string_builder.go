@@ -5,6 +5,7 @@
 package internal
 
 import (
+	"io"
 	"unicode/utf8"
 	"unsafe"
 )
@@ -124,6 +125,30 @@ func (b *StringBuilder) WriteString(s string) (int, error) {
 	return len(s), nil
 }
 
+// WriteQuotedRaw appends s between double quotes, without escaping it. It is meant for tokens
+// known not to need escaping, such as constants or strings already sanitized.
+func (b *StringBuilder) WriteQuotedRaw(s string) {
+	b.copyCheck()
+	b.buf = append(b.buf, '"')
+	b.buf = append(b.buf, s...)
+	b.buf = append(b.buf, '"')
+}
+
+// WriteQuotedSanitized appends s between double quotes, written by sanitize, which escapes
+// or replaces the characters that are not allowed between the quotes.
+func (b *StringBuilder) WriteQuotedSanitized(s string, sanitize func(*StringBuilder, string)) {
+	b.WriteByte('"')
+	sanitize(b, s)
+	b.WriteByte('"')
+}
+
+// WriteTo writes the accumulated bytes to w. It implements io.WriterTo.
+// The buffer is left intact, call Reset to reuse the builder.
+func (b *StringBuilder) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write(b.buf)
+	return int64(n), err
+}
+
 func (b *StringBuilder) GetBuf() []byte {
 	return b.buf
 }
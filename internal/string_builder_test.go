@@ -0,0 +1,42 @@
+package internal
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStringBuilderWriteTo(t *testing.T) {
+	var sb StringBuilder
+	sb.WriteString("foo.metric 1.2")
+	sb.WriteByte('\n')
+
+	var w bytes.Buffer
+	n, err := sb.WriteTo(&w)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(15), n)
+	assert.Equal(t, "foo.metric 1.2\n", w.String())
+	assert.Equal(t, "foo.metric 1.2\n", sb.String())
+
+	var _ io.WriterTo = &sb
+}
+
+func TestStringBuilderWriteQuotedRaw(t *testing.T) {
+	var sb StringBuilder
+	sb.WriteQuotedRaw("_spanLogs")
+	sb.WriteByte('=')
+	sb.WriteQuotedRaw("")
+	sb.WriteByte(' ')
+	sb.WriteQuotedSanitized("a b", func(b *StringBuilder, s string) {
+		for i := 0; i < len(s); i++ {
+			if s[i] == ' ' {
+				b.WriteByte('-')
+			} else {
+				b.WriteByte(s[i])
+			}
+		}
+	})
+	assert.Equal(t, `"_spanLogs"="" "a-b"`, sb.String())
+}
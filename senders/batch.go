@@ -0,0 +1,50 @@
+package senders
+
+import (
+	"github.com/wavefronthq/wavefront-sdk-go/internal"
+)
+
+// MetricBatch formats many metric points into a single reusable buffer.
+// A MetricBatch must not be copied after first use and is not safe for concurrent use.
+type MetricBatch struct {
+	sb            internal.StringBuilder
+	defaultSource string
+	cfg           *lineConfig
+}
+
+// NewMetricBatch creates an empty batch. defaultSource is used for points added without a source.
+func NewMetricBatch(defaultSource string, setters ...LineOption) *MetricBatch {
+	return &MetricBatch{
+		defaultSource: defaultSource,
+		cfg:           newLineConfig(setters),
+	}
+}
+
+// Add formats a metric point and appends it to the batch. It validates the point like MetricLine;
+// an invalid point returns an error and leaves the lines already in the batch untouched.
+func (b *MetricBatch) Add(name string, value float64, ts int64, source string, tags map[string]string) error {
+	n := b.sb.Len()
+	scratch := getTagScratch()
+	defer putTagScratch(scratch)
+	if err := writeMetricLine(&b.sb, name, value, "", ts, source, scratch.mapTags(nil, tags), b.defaultSource, b.cfg); err != nil {
+		b.sb.SetBuf(b.sb.GetBuf()[:n])
+		return err
+	}
+	observeLine(LineKindMetric, b.sb.GetBuf(), n)
+	return nil
+}
+
+// Bytes returns the formatted lines. The slice is only valid until the next call to Add or Reset.
+func (b *MetricBatch) Bytes() []byte {
+	return b.sb.GetBuf()
+}
+
+// Len returns the number of bytes in the batch.
+func (b *MetricBatch) Len() int {
+	return b.sb.Len()
+}
+
+// Reset empties the batch, keeping the allocated buffer for reuse.
+func (b *MetricBatch) Reset() {
+	b.sb.Reset()
+}
@@ -0,0 +1,32 @@
+package senders
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricBatch(t *testing.T) {
+	batch := NewMetricBatch("default")
+	assert.Nil(t, batch.Add("foo.metric", 1.2, 1533529977, "test_source", map[string]string{"env": "test"}))
+	assert.NotNil(t, batch.Add("", 1.2, 1533529977, "test_source", nil))
+	assert.NotNil(t, batch.Add("bad.metric", 1.2, 1533529977, "test_source", map[string]string{"env": ""}))
+	assert.Nil(t, batch.Add("bar.metric", 3, 0, "", nil))
+
+	expected := "\"foo.metric\" 1.2 1533529977 source=\"test_source\" \"env\"=\"test\"\n" +
+		"\"bar.metric\" 3 source=\"default\"\n"
+	assert.Equal(t, expected, string(batch.Bytes()))
+	assert.Equal(t, len(expected), batch.Len())
+
+	batch.Reset()
+	assert.Equal(t, 0, batch.Len())
+	assert.Nil(t, batch.Add("baz.metric", 1, 0, "test_source", nil))
+	assert.Equal(t, "\"baz.metric\" 1 source=\"test_source\"\n", string(batch.Bytes()))
+}
+
+func TestMetricBatchOptions(t *testing.T) {
+	batch := NewMetricBatch("", MaxSourceLength(3))
+	assert.NotNil(t, batch.Add("foo.metric", 1, 0, "test_source", nil))
+	assert.Nil(t, batch.Add("foo.metric", 1, 0, "src", nil))
+	assert.Equal(t, "\"foo.metric\" 1 source=\"src\"\n", string(batch.Bytes()))
+}
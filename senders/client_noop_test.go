@@ -38,7 +38,7 @@ func TestNoOpSender(t *testing.T) {
 		t.Error("Failed SendDeltaCounter", err)
 	}
 
-	if err := wf.SendSpan("getAllUsers", 0, 343500, "localhost",
+	if err := wf.SendSpan("getAllUsers", 1533531013, 343500, "localhost",
 		"7b3bf470-9456-11e8-9eb6-529269fb1459", "0313bafe-9457-11e8-9eb6-529269fb1459",
 		[]string{"2f64e538-9457-11e8-9eb6-529269fb1459"}, nil,
 		[]senders.SpanTag{
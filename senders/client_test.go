@@ -1,10 +1,15 @@
 package senders_test
 
 import (
+	"compress/gzip"
 	"context"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"strings"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -91,7 +96,7 @@ func doTest(t *testing.T, wf senders.Sender) {
 		t.Error("Failed SendDistribution", err)
 	}
 
-	if err := wf.SendSpan("getAllUsers", 0, 343500, "localhost",
+	if err := wf.SendSpan("getAllUsers", 1533531013, 343500, "localhost",
 		"7b3bf470-9456-11e8-9eb6-529269fb1459", "0313bafe-9457-11e8-9eb6-529269fb1459",
 		[]string{"2f64e538-9457-11e8-9eb6-529269fb1459"}, nil,
 		[]senders.SpanTag{
@@ -106,3 +111,108 @@ func doTest(t *testing.T, wf senders.Sender) {
 	wf.Close()
 	assert.Equal(t, int64(0), wf.GetFailureCount(), "GetFailureCount")
 }
+
+// recordingServer is a Wavefront server recording the reported lines by format.
+type recordingServer struct {
+	*httptest.Server
+	mtx   sync.Mutex
+	lines map[string][]string
+}
+
+func newRecordingServer() *recordingServer {
+	rs := &recordingServer{lines: map[string][]string{}}
+	rs.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body io.Reader = r.Body
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			zr, err := gzip.NewReader(r.Body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			body = zr
+		}
+		data, _ := ioutil.ReadAll(body)
+		format := r.URL.Query().Get("f")
+
+		rs.mtx.Lock()
+		for _, line := range strings.Split(string(data), "\n") {
+			if line != "" {
+				rs.lines[format] = append(rs.lines[format], line)
+			}
+		}
+		rs.mtx.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	return rs
+}
+
+func (rs *recordingServer) Lines(format string) []string {
+	rs.mtx.Lock()
+	defer rs.mtx.Unlock()
+	return rs.lines[format]
+}
+
+func TestSendSpanCanonicalIds(t *testing.T) {
+	newSenders := map[string]func(url string) (senders.Sender, error){
+		"client": func(url string) (senders.Sender, error) {
+			return senders.NewSender(strings.Replace(url, "http://", "http://"+token+"@", 1))
+		},
+		"direct": func(url string) (senders.Sender, error) {
+			return senders.NewDirectSender(&senders.DirectConfiguration{Server: url, Token: token})
+		},
+	}
+	for name, newSender := range newSenders {
+		rs := newRecordingServer()
+		wf, err := newSender(rs.URL)
+		assert.Nil(t, err, name)
+
+		// uppercase ids, and ids as 32 hex characters without hyphens
+		ids := [][2]string{
+			{"7B3BF470-9456-11E8-9EB6-529269FB1459", "0313BAFE-9457-11E8-9EB6-529269FB1459"},
+			{"7b3bf470945611e89eb6529269fb1459", "0313BAFE945711E89EB6529269FB1459"},
+		}
+		for _, id := range ids {
+			err = wf.SendSpan("getAllUsers", 1533531013, 343500, "localhost", id[0], id[1], nil, nil, nil,
+				[]senders.SpanLog{{Timestamp: 1533531013, Fields: map[string]string{"event": "error"}}})
+			assert.Nil(t, err, name)
+		}
+		wf.Flush()
+		wf.Close()
+
+		spans := rs.Lines("trace")
+		if assert.Len(t, spans, len(ids), name) {
+			for _, span := range spans {
+				assert.Contains(t, span, "traceId=7b3bf470-9456-11e8-9eb6-529269fb1459 spanId=0313bafe-9457-11e8-9eb6-529269fb1459", name)
+			}
+		}
+		logs := rs.Lines("spanLogs")
+		if assert.Len(t, logs, len(ids), name) {
+			for _, log := range logs {
+				assert.Contains(t, log, `"traceId":"7b3bf470-9456-11e8-9eb6-529269fb1459","spanId":"0313bafe-9457-11e8-9eb6-529269fb1459"`, name)
+			}
+		}
+		rs.Close()
+	}
+}
+
+func TestSendSpanInvalidLogs(t *testing.T) {
+	rs := newRecordingServer()
+	defer rs.Close()
+	wf, err := senders.NewDirectSender(&senders.DirectConfiguration{Server: rs.URL, Token: token})
+	assert.Nil(t, err)
+
+	for _, logs := range [][]senders.SpanLog{
+		{{Timestamp: 0, Fields: map[string]string{"event": "error"}}},
+		{{Timestamp: 1533531013}},
+	} {
+		err = wf.SendSpan("getAllUsers", 1533531013, 343500, "localhost",
+			"7b3bf470-9456-11e8-9eb6-529269fb1459", "0313bafe-9457-11e8-9eb6-529269fb1459", nil, nil, nil, logs)
+		assert.NotNil(t, err)
+	}
+	wf.Flush()
+	wf.Close()
+
+	// neither the span nor its logs are sent
+	assert.Empty(t, rs.Lines("trace"))
+	assert.Empty(t, rs.Lines("spanLogs"))
+}
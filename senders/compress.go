@@ -0,0 +1,65 @@
+package senders
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"sync"
+)
+
+var (
+	compressBuffers *sync.Pool
+
+	// gzip writers are pooled per compression level, indexed by level - gzip.HuffmanOnly
+	gzipWriters [gzip.BestCompression - gzip.HuffmanOnly + 1]sync.Pool
+)
+
+func init() {
+	compressBuffers = &sync.Pool{
+		New: func() interface{} {
+			return new(bytes.Buffer)
+		},
+	}
+}
+
+// CompressLines gzips a batch of formatted lines using the default compression level.
+// The result can be sent to the proxy compressed ingestion endpoint.
+func CompressLines(lines []byte) ([]byte, error) {
+	return CompressLinesLevel(lines, gzip.DefaultCompression)
+}
+
+// CompressLinesLevel is like CompressLines with the given gzip compression level,
+// from gzip.HuffmanOnly to gzip.BestCompression.
+func CompressLinesLevel(lines []byte, level int) ([]byte, error) {
+	if level < gzip.HuffmanOnly || level > gzip.BestCompression {
+		return nil, fmt.Errorf("invalid gzip compression level: %d", level)
+	}
+
+	buf := compressBuffers.Get().(*bytes.Buffer)
+	defer func() {
+		buf.Reset()
+		compressBuffers.Put(buf)
+	}()
+
+	writers := &gzipWriters[level-gzip.HuffmanOnly]
+	zw, ok := writers.Get().(*gzip.Writer)
+	if ok {
+		zw.Reset(buf)
+	} else {
+		// the level was checked above, NewWriterLevel cannot fail
+		zw, _ = gzip.NewWriterLevel(buf, level)
+	}
+	defer writers.Put(zw)
+
+	if _, err := zw.Write(lines); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	// copy out, the buffer is reused once returned to the pool
+	out := make([]byte, buf.Len())
+	copy(out, buf.Bytes())
+	return out, nil
+}
@@ -0,0 +1,47 @@
+package senders
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func decompress(t *testing.T, data []byte) string {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	assert.Nil(t, err)
+	out, err := ioutil.ReadAll(zr)
+	assert.Nil(t, err)
+	return string(out)
+}
+
+func TestCompressLines(t *testing.T) {
+	lines := strings.Repeat("\"foo.metric\" 1.2 1533529977 source=\"test_source\" \"env\"=\"test\"\n", 100)
+
+	first, err := CompressLines([]byte(lines))
+	assert.Nil(t, err)
+	assert.True(t, len(first) < len(lines))
+
+	second, err := CompressLines([]byte("\"bar.metric\" 1 source=\"test_source\"\n"))
+	assert.Nil(t, err)
+
+	assert.Equal(t, lines, decompress(t, first))
+	assert.Equal(t, "\"bar.metric\" 1 source=\"test_source\"\n", decompress(t, second))
+}
+
+func TestCompressLinesLevel(t *testing.T) {
+	lines := "\"foo.metric\" 1.2 1533529977 source=\"test_source\" \"env\"=\"test\"\n"
+	for level := gzip.HuffmanOnly; level <= gzip.BestCompression; level++ {
+		out, err := CompressLinesLevel([]byte(lines), level)
+		assert.Nil(t, err)
+		assert.Equal(t, lines, decompress(t, out))
+	}
+
+	_, err := CompressLinesLevel([]byte(lines), gzip.BestCompression+1)
+	assert.NotNil(t, err)
+	_, err = CompressLinesLevel([]byte(lines), gzip.HuffmanOnly-1)
+	assert.NotNil(t, err)
+}
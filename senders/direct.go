@@ -177,6 +177,11 @@ func (sender *directSender) SendDistribution(name string, centroids []histogram.
 
 func (sender *directSender) SendSpan(name string, startMillis, durationMillis int64, source, traceId, spanId string,
 	parents, followsFrom []string, tags []SpanTag, spanLogs []SpanLog) error {
+	logs, err := spanLogsLine(traceId, spanId, spanLogs)
+	if err != nil {
+		sender.spanLogsInvalid.Inc()
+		return err
+	}
 	line, err := SpanLine(name, startMillis, durationMillis, source, traceId, spanId, parents, followsFrom, tags, spanLogs, sender.defaultSource)
 	if err != nil {
 		sender.spansInvalid.Inc()
@@ -190,14 +195,8 @@ func (sender *directSender) SendSpan(name string, startMillis, durationMillis in
 		return err
 	}
 
-	if len(spanLogs) > 0 {
-		logs, err := SpanLogJSON(traceId, spanId, spanLogs)
-		if err != nil {
-			sender.spanLogsInvalid.Inc()
-			return err
-		} else {
-			sender.spanLogsValid.Inc()
-		}
+	if logs != "" {
+		sender.spanLogsValid.Inc()
 		err = sender.spanLogHandler.HandleLine(logs)
 		if err != nil {
 			sender.spanLogsDropped.Inc()
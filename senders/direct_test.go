@@ -45,7 +45,7 @@ func TestDirectSends(t *testing.T) {
 		t.Error("Failed SendDistribution", err)
 	}
 
-	if err = direct.SendSpan("getAllUsers", 0, 343500, "localhost",
+	if err = direct.SendSpan("getAllUsers", 1533531013, 343500, "localhost",
 		"7b3bf470-9456-11e8-9eb6-529269fb1459", "0313bafe-9457-11e8-9eb6-529269fb1459",
 		[]string{"2f64e538-9457-11e8-9eb6-529269fb1459"}, nil,
 		[]senders.SpanTag{
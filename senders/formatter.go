@@ -2,11 +2,19 @@ package senders
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
-	"errors"
 	"fmt"
+	"io"
+	"math"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
 
 	"github.com/wavefronthq/wavefront-sdk-go/event"
 	"github.com/wavefronthq/wavefront-sdk-go/histogram"
@@ -16,186 +24,1566 @@ import (
 // Gets a metric line in the Wavefront metrics data format:
 // <metricName> <metricValue> [<timestamp>] source=<source> [pointTags]
 // Example: "new-york.power.usage 42422.0 1533531013 source=localhost datacenter=dc1"
-func MetricLine(name string, value float64, ts int64, source string, tags map[string]string, defaultSource string) (string, error) {
+// A zero ts omits the timestamp so the server assigns the time the line is received,
+// the ServerTimestamp option does the same for any ts.
+func MetricLine(name string, value float64, ts int64, source string, tags map[string]string, defaultSource string, setters ...LineOption) (string, error) {
+	sb := internal.GetBuffer()
+	defer internal.PutBuffer(sb)
+
+	scratch := getTagScratch()
+	defer putTagScratch(scratch)
+	if err := writeMetricLine(sb, name, value, "", ts, source, scratch.mapTags(nil, tags), defaultSource, newLineConfig(setters)); err != nil {
+		return "", err
+	}
+	return formatted(LineKindMetric, string(sb.GetBuf())), nil
+}
+
+// MetricLineTags is like MetricLine but takes the point tags as a TagSource, which lets
+// callers keeping their tags in a slice avoid building a map for every line.
+// Tags are written in the order given by the source.
+func MetricLineTags(name string, value float64, ts int64, source string, tags TagSource, defaultSource string, setters ...LineOption) (string, error) {
+	sb := internal.GetBuffer()
+	defer internal.PutBuffer(sb)
+
+	if err := writeMetricLine(sb, name, value, "", ts, source, tags, defaultSource, newLineConfig(setters)); err != nil {
+		return "", err
+	}
+	return formatted(LineKindMetric, string(sb.GetBuf())), nil
+}
+
+// MetricLineCommonTags is like MetricLine for the union of common tags, such as env or region,
+// and the tags of the point, the point tags taking precedence. The result is the same as
+// passing MergeTags(common, tags) to MetricLine, without building the merged map.
+func MetricLineCommonTags(name string, value float64, ts int64, source string, common, tags map[string]string, defaultSource string, setters ...LineOption) (string, error) {
+	sb := internal.GetBuffer()
+	defer internal.PutBuffer(sb)
+
+	scratch := getTagScratch()
+	defer putTagScratch(scratch)
+	if err := writeMetricLine(sb, name, value, "", ts, source, scratch.mapTags(common, tags), defaultSource, newLineConfig(setters)); err != nil {
+		return "", err
+	}
+	return formatted(LineKindMetric, string(sb.GetBuf())), nil
+}
+
+// MetricLineSanitizedTags is like MetricLine for tags sanitized up front with SanitizeTags,
+// which are written as they are.
+func MetricLineSanitizedTags(name string, value float64, ts int64, source string, tags SanitizedTags, defaultSource string, setters ...LineOption) (string, error) {
+	sb := internal.GetBuffer()
+	defer internal.PutBuffer(sb)
+
+	// a copy, the tags are shared by many lines
+	sorted := tags.tags
+	if err := writeMetricLine(sb, name, value, "", ts, source, &sorted, defaultSource, newLineConfig(setters)); err != nil {
+		return "", err
+	}
+	return formatted(LineKindMetric, string(sb.GetBuf())), nil
+}
+
+// MetricLineRaw is like MetricLine but writes the value exactly as given, for values such as
+// decimal counters that must not go through float64. The value must be a plain decimal
+// number: an optional sign, digits and an optional fraction, without an exponent.
+func MetricLineRaw(name string, value string, ts int64, source string, tags map[string]string, defaultSource string, setters ...LineOption) (string, error) {
+	if value == "" {
+		return "", newFormatError("value", "empty metric value")
+	}
+	sb := internal.GetBuffer()
+	defer internal.PutBuffer(sb)
+
+	scratch := getTagScratch()
+	defer putTagScratch(scratch)
+	if err := writeMetricLine(sb, name, 0, value, ts, source, scratch.mapTags(nil, tags), defaultSource, newLineConfig(setters)); err != nil {
+		return "", err
+	}
+	return formatted(LineKindMetric, string(sb.GetBuf())), nil
+}
+
+// MetricLineJSON encodes a metric point as a JSON object with the fields name, value,
+// timestamp, source and tags, for ingestion paths taking JSON rather than lines. The point is
+// validated like MetricLine. The name and tag keys are sanitized and the source and tag values
+// are trimmed as in a metric line, without quoting or escaping, which JSON takes care of.
+// The source is limited to MaxSourceLength characters like in a metric line.
+// The timestamp, source and tags fields are left out when zero or empty.
+func MetricLineJSON(name string, value float64, ts int64, source string, tags map[string]string, setters ...LineOption) (string, error) {
 	if name == "" {
-		return "", errors.New("empty metric name")
+		return "", newFormatError("name", "empty metric name")
+	}
+	if math.IsNaN(value) {
+		return "", newFormatError("value", "metric value is NaN")
+	}
+	if math.IsInf(value, 0) {
+		return "", newFormatError("value", "metric value is infinite")
+	}
+	if ts < 0 {
+		return "", newFormatError("timestamp", "timestamp cannot be negative: %d", ts)
 	}
 
-	if source == "" {
-		source = defaultSource
+	cfg := newLineConfig(setters)
+	m := metricJSON{Name: sanitizeInternal(name), Value: value, Timestamp: ts, Source: strings.TrimSpace(source)}
+	if cfg.maxSourceLength > 0 {
+		if n := utf8.RuneCountInString(m.Source); n > cfg.maxSourceLength {
+			return "", newFormatError("source", "source exceeds the maximum length of %d characters: %d", cfg.maxSourceLength, n)
+		}
+	}
+	if len(tags) > 0 {
+		m.Tags = make(map[string]string, len(tags))
+		origKeys := make(map[string]string, len(tags))
+		for k, v := range tags {
+			if k == "" {
+				return "", errBlankMetricTagKey
+			}
+			if strings.TrimSpace(v) == "" {
+				return "", errBlankMetricTag
+			}
+			key := sanitizeInternal(k)
+			if orig, ok := origKeys[key]; ok {
+				return "", newFormatError("tags", "tag keys %q and %q are the same once sanitized", orig, k)
+			}
+			origKeys[key] = k
+			m.Tags[key] = strings.TrimSpace(v)
+		}
+	}
+
+	jsonData, err := json.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+	return string(jsonData), nil
+}
+
+// metricJSON is the JSON object of MetricLineJSON.
+type metricJSON struct {
+	Name      string            `json:"name"`
+	Value     float64           `json:"value"`
+	Timestamp int64             `json:"timestamp,omitempty"`
+	Source    string            `json:"source,omitempty"`
+	Tags      map[string]string `json:"tags,omitempty"`
+}
+
+// isDecimalLiteral reports whether s is a plain decimal number like -12, 0.1 or .5.
+func isDecimalLiteral(s string) bool {
+	if s != "" && (s[0] == '+' || s[0] == '-') {
+		s = s[1:]
+	}
+	digits, dot := 0, false
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case '0' <= c && c <= '9':
+			digits++
+		case c == '.' && !dot:
+			dot = true
+		default:
+			return false
+		}
+	}
+	return digits > 0
+}
+
+// minMillisTimestamp is 1973-03-03 in epoch milliseconds. Epoch seconds stay below it
+// until the year 5138, so any positive timestamp under it is taken to be in seconds.
+const minMillisTimestamp = 100000000000
+
+// MetricLineMillis is like MetricLine but takes the timestamp in epoch milliseconds,
+// which keeps the ordering of points reported within the same second.
+// As with MetricLine a zero tsMillis omits the timestamp and the server assigns it.
+// A positive tsMillis below minMillisTimestamp looks like epoch seconds and is rejected.
+func MetricLineMillis(name string, value float64, tsMillis int64, source string, tags map[string]string, defaultSource string, setters ...LineOption) (string, error) {
+	if tsMillis > 0 && tsMillis < minMillisTimestamp {
+		return "", newFormatError("timestamp", "timestamp %d looks like epoch seconds, not milliseconds", tsMillis)
 	}
+	return MetricLine(name, value, tsMillis, source, tags, defaultSource, setters...)
+}
 
+// MetricLinePreSanitized is like MetricLine for a name that is already sanitized, such as a
+// constant checked once with SanitizeName, and skips sanitizing it for every line. The name is
+// still quoted but written as it is: it is unsafe to pass a name that SanitizeName changes,
+// as a quote, space or newline in it corrupts the line or the lines following it.
+func MetricLinePreSanitized(name string, value float64, ts int64, source string, tags map[string]string, defaultSource string, setters ...LineOption) (string, error) {
 	sb := internal.GetBuffer()
 	defer internal.PutBuffer(sb)
 
-	sb.WriteByte('"')
-	sanitizeInternalSb(sb, name)
-	sb.WriteByte('"')
+	cfg := *newLineConfig(setters)
+	cfg.preSanitizedName = true
+	scratch := getTagScratch()
+	defer putTagScratch(scratch)
+	if err := writeMetricLine(sb, name, value, "", ts, source, scratch.mapTags(nil, tags), defaultSource, &cfg); err != nil {
+		return "", err
+	}
+	return formatted(LineKindMetric, string(sb.GetBuf())), nil
+}
+
+// DeltaCounterLine gets a metric line for a delta counter. The ∆ prefix is prepended
+// to the name unless it already starts with ∆ (U+2206) or Δ (U+0394).
+func DeltaCounterLine(name string, value float64, ts int64, source string, tags map[string]string, defaultSource string, setters ...LineOption) (string, error) {
+	if name == "" {
+		return "", newFormatError("name", "empty metric name")
+	}
+	return MetricLine(internal.DeltaCounterName(name), value, ts, source, tags, defaultSource, setters...)
+}
+
+// MetricLineInto appends a metric line to dst and returns the extended buffer.
+// It formats and validates exactly like MetricLine. On error dst is returned unchanged.
+func MetricLineInto(dst []byte, name string, value float64, ts int64, source string, tags map[string]string, defaultSource string, setters ...LineOption) ([]byte, error) {
+	var sb internal.StringBuilder
+	sb.SetBuf(dst)
+	scratch := getTagScratch()
+	defer putTagScratch(scratch)
+	if err := writeMetricLine(&sb, name, value, "", ts, source, scratch.mapTags(nil, tags), defaultSource, newLineConfig(setters)); err != nil {
+		return dst, err
+	}
+	observeLine(LineKindMetric, sb.GetBuf(), len(dst))
+	return sb.GetBuf(), nil
+}
+
+// WriteMetricLine formats a metric line like MetricLine into a pooled buffer and writes it to w,
+// without an intermediate string. It returns the number of bytes written. Nothing is written
+// if the line fails to format.
+func WriteMetricLine(w io.Writer, name string, value float64, ts int64, source string, tags map[string]string, defaultSource string, setters ...LineOption) (int, error) {
+	sb := internal.GetBuffer()
+	defer internal.PutBuffer(sb)
+
+	scratch := getTagScratch()
+	defer putTagScratch(scratch)
+	if err := writeMetricLine(sb, name, value, "", ts, source, scratch.mapTags(nil, tags), defaultSource, newLineConfig(setters)); err != nil {
+		return 0, err
+	}
+	observeLine(LineKindMetric, sb.GetBuf(), 0)
+	n, err := sb.WriteTo(w)
+	return int(n), err
+}
+
+// writeMetricLine writes a metric line. A non-empty rawValue is written in place of value.
+func writeMetricLine(sb *internal.StringBuilder, name string, value float64, rawValue string, ts int64, source string, tags TagSource, defaultSource string, cfg *lineConfig) error {
+	if name == "" {
+		return newFormatError("name", "empty metric name")
+	}
+	start := sb.Len()
+	if cfg.serverTimestamp {
+		ts = 0
+	}
+	if cfg.metricType != 0 {
+		var err error
+		if name, err = checkMetricType(name, tags, cfg.metricType); err != nil {
+			return err
+		}
+	}
+	if cfg.maxPointTags > 0 {
+		var err error
+		if tags, err = limitPointTags(tags, cfg); err != nil {
+			return err
+		}
+	}
+
+	if rawValue != "" {
+		if !isDecimalLiteral(rawValue) {
+			return newFormatError("value", "metric value is not a decimal number: %q", rawValue)
+		}
+	} else if math.IsNaN(value) {
+		return newFormatError("value", "metric value is NaN")
+	} else if math.IsInf(value, 0) {
+		return newFormatError("value", "metric value is infinite")
+	}
+
+	if ts < 0 {
+		return newFormatError("timestamp", "timestamp cannot be negative: %d", ts)
+	}
+
+	if err := checkFloatFormat(cfg); err != nil {
+		return err
+	}
+
+	if source == "" {
+		source = defaultSource
+	}
+
+	if err := checkNewlines(cfg, name, source, tags); err != nil {
+		return err
+	}
+	// Points without tags, such as most counters, skip the per-tag checks, sizing and writes.
+	hasTags := tags.Len() > 0
+	if hasTags {
+		if err := checkTagKeys(cfg, tags); err != nil {
+			return err
+		}
+		sb.Grow(lineSizeHint(name, source, tags) + 48)
+	} else {
+		sb.Grow(len(name) + len(source) + 60)
+	}
+
+	// value and timestamp
+	writeName(sb, name, cfg)
 
 	sb.WriteByte(' ')
-	sb.SetBuf(strconv.AppendFloat(sb.GetBuf(), value, 'f', -1, 64))
+	if rawValue != "" {
+		sb.WriteString(rawValue)
+	} else {
+		sb.SetBuf(appendValue(sb.GetBuf(), value, cfg.floatFormat))
+	}
 
 	if ts != 0 {
 		sb.WriteByte(' ')
 		sb.SetBuf(strconv.AppendInt(sb.GetBuf(), ts, 10))
 	}
 
-	sb.WriteString(" source=")
-	sanitizeValueSb(sb, source)
+	if err := writeSource(sb, source, cfg); err != nil {
+		return err
+	}
 
-	for k, v := range tags {
-		if v == "" {
-			return "", errors.New("metric point tag value cannot be blank")
-		}
+	if cfg.metricType != 0 {
 		sb.WriteByte(' ')
-
-		sb.WriteByte('"')
-		sanitizeInternalSb(sb, k)
-		sb.WriteByte('"')
+		sb.WriteQuotedRaw(MetricTypeTagKey)
 		sb.WriteByte('=')
-		sanitizeValueSb(sb, v)
+		sb.WriteQuotedRaw(cfg.metricType.String())
+	}
+	if hasTags {
+		if err := writeTags(sb, tags, errBlankMetricTagKey, errBlankMetricTag, cfg); err != nil {
+			return err
+		}
+	}
+	if err := checkLineLength(sb.Len()-start, cfg); err != nil {
+		return err
 	}
 	sb.WriteByte('\n')
-	return sb.String(), nil
+	return nil
+}
+
+// checkMetricType checks a metric set with MetricTypeTag and returns its name, with the delta
+// prefix for a delta counter.
+func checkMetricType(name string, tags TagSource, t MetricType) (string, error) {
+	switch t {
+	case MetricTypeDelta:
+		name = internal.DeltaCounterName(name)
+	case MetricTypeGauge, MetricTypeCounter:
+		if internal.HasDeltaPrefix(name) {
+			return "", newFormatError("name", "metric name %q has the delta prefix but the type is %s", name, t)
+		}
+	default:
+		return "", newFormatError("tags", "invalid metric type %d", t)
+	}
+	for i := 0; i < tags.Len(); i++ {
+		if k, _ := tags.Tag(i); k == MetricTypeTagKey {
+			return "", newFormatError("tags", "tag key %q is reserved for the metric type", k)
+		}
+	}
+	return name, nil
+}
+
+// limitPointTags applies MaxPointTags or TruncatePointTags to the point tags.
+func limitPointTags(tags TagSource, cfg *lineConfig) (TagSource, error) {
+	n := tags.Len()
+	if n <= cfg.maxPointTags {
+		return tags, nil
+	}
+	if !cfg.truncatePointTags {
+		return nil, newFormatError("tags", "point has %d tags, more than the maximum of %d", n, cfg.maxPointTags)
+	}
+	if sorted, ok := tags.(*mapTags); ok {
+		truncated := (*sorted)[:cfg.maxPointTags]
+		return &truncated, nil
+	}
+	return truncatedTags{tags, cfg.maxPointTags}, nil
+}
+
+// truncatedTags is the first n tags of a tag source.
+type truncatedTags struct {
+	TagSource
+	n int
+}
+
+func (t truncatedTags) Len() int {
+	return t.n
 }
 
 // Gets a histogram line in the Wavefront histogram data format:
 // {!M | !H | !D} [<timestamp>] #<count> <mean> [centroids] <histogramName> source=<source> [pointTags]
 // Example: "!M 1533531013 #20 30.0 #10 5.1 request.latency source=appServer1 region=us-west"
-func HistoLine(name string, centroids histogram.Centroids, hgs map[histogram.Granularity]bool, ts int64, source string, tags map[string]string, defaultSource string) (string, error) {
-	if name == "" {
-		return "", errors.New("empty distribution name")
+// As with MetricLine a zero ts, or the ServerTimestamp option, omits the timestamp.
+// The format has no directive to clear a distribution: distributions are aggregated per
+// granularity interval, so a source that stops reporting simply has no data for later intervals.
+func HistoLine(name string, centroids histogram.Centroids, hgs map[histogram.Granularity]bool, ts int64, source string, tags map[string]string, defaultSource string, setters ...LineOption) (string, error) {
+	return HistoLineGranularities(name, centroids, enabledGranularities(hgs), ts, source, tags, defaultSource, setters...)
+}
+
+// HistoLineGranularities is like HistoLine but takes the enabled granularities as a slice.
+// Duplicates are ignored and one line is emitted per granularity, always in the order minute, hour, day.
+func HistoLineGranularities(name string, centroids histogram.Centroids, gran []histogram.Granularity, ts int64, source string, tags map[string]string, defaultSource string, setters ...LineOption) (string, error) {
+	sb := internal.GetBuffer()
+	defer internal.PutBuffer(sb)
+
+	scratch := getTagScratch()
+	defer putTagScratch(scratch)
+	if err := writeHistoLine(context.Background(), sb, name, centroids, gran, ts, source, scratch.mapTags(nil, tags), defaultSource, newLineConfig(setters)); err != nil {
+		return "", err
 	}
+	return formatted(LineKindHistogram, string(sb.GetBuf())), nil
+}
 
-	if len(centroids) == 0 {
-		return "", errors.New("distribution should have at least one centroid")
+// HistoLineContext is like HistoLine but stops formatting and returns the context error
+// once ctx is done. The context is checked periodically while writing the centroids.
+func HistoLineContext(ctx context.Context, name string, centroids histogram.Centroids, hgs map[histogram.Granularity]bool, ts int64, source string, tags map[string]string, defaultSource string, setters ...LineOption) (string, error) {
+	sb := internal.GetBuffer()
+	defer internal.PutBuffer(sb)
+
+	scratch := getTagScratch()
+	defer putTagScratch(scratch)
+	if err := writeHistoLine(ctx, sb, name, centroids, enabledGranularities(hgs), ts, source, scratch.mapTags(nil, tags), defaultSource, newLineConfig(setters)); err != nil {
+		return "", err
 	}
+	return formatted(LineKindHistogram, string(sb.GetBuf())), nil
+}
 
-	if len(hgs) == 0 {
-		return "", errors.New("histogram granularities cannot be empty")
+// HistoLineFromBuckets is like HistoLine for a pre-binned distribution, see histogram.CentroidsFromBuckets
+// for how bucket bounds and counts map to centroids.
+func HistoLineFromBuckets(name string, bounds []float64, counts []uint64, hgs map[histogram.Granularity]bool, ts int64, source string, tags map[string]string, defaultSource string, setters ...LineOption) (string, error) {
+	centroids, err := histogram.CentroidsFromBuckets(bounds, counts)
+	if err != nil {
+		return "", err
 	}
+	return HistoLine(name, centroids, hgs, ts, source, tags, defaultSource, setters...)
+}
 
-	if source == "" {
-		source = defaultSource
+// HistoBody formats the part of a histogram line shared by all granularities: the timestamp,
+// centroids, name, source and tags. Pass it to HistoLineFromBody to get the histogram lines,
+// for instance to send the same distribution again without formatting the centroids again.
+func HistoBody(name string, centroids histogram.Centroids, ts int64, source string, tags map[string]string, defaultSource string, setters ...LineOption) (string, error) {
+	sb := internal.GetBuffer()
+	defer internal.PutBuffer(sb)
+
+	scratch := getTagScratch()
+	defer putTagScratch(scratch)
+	if err := writeHistoBody(context.Background(), sb, name, centroids, ts, source, scratch.mapTags(nil, tags), defaultSource, newLineConfig(setters), nil); err != nil {
+		return "", err
+	}
+	return string(sb.GetBuf()), nil
+}
+
+// HistoLineFromBody gets the histogram lines of a body from HistoBody for the enabled
+// granularities, producing the same output as HistoLine.
+func HistoLineFromBody(body string, hgs map[histogram.Granularity]bool, setters ...LineOption) (string, error) {
+	if body == "" || body[0] != ' ' || strings.IndexByte(body, '\n') >= 0 {
+		return "", newFormatError("body", "invalid histogram body %q", body)
+	}
+	enabled, err := enabledGranularityFlags(enabledGranularities(hgs))
+	if err != nil {
+		return "", err
 	}
 
 	sb := internal.GetBuffer()
 	defer internal.PutBuffer(sb)
 
-	if ts != 0 {
-		sb.WriteByte(' ')
-		sb.SetBuf(strconv.AppendInt(sb.GetBuf(), ts, 10))
+	if err := writeHistoGranularities(sb, body, enabled, newLineConfig(setters)); err != nil {
+		return "", err
 	}
-	// Preprocess line. We know len(hgs) > 0 here.
-	for _, centroid := range centroids.Compact() {
-		sb.WriteString(" #")
-		sb.SetBuf(strconv.AppendInt(sb.GetBuf(), int64(centroid.Count), 10))
-		sb.WriteByte(' ')
-		sb.SetBuf(strconv.AppendFloat(sb.GetBuf(), centroid.Value, 'f', -1, 64))
+	return formatted(LineKindHistogram, string(sb.GetBuf())), nil
+}
+
+// HistoLineInto appends the histogram lines to dst and returns the extended buffer.
+// It formats and validates exactly like HistoLine. On error dst is returned unchanged.
+func HistoLineInto(dst []byte, name string, centroids histogram.Centroids, hgs map[histogram.Granularity]bool, ts int64, source string, tags map[string]string, defaultSource string, setters ...LineOption) ([]byte, error) {
+	var sb internal.StringBuilder
+	sb.SetBuf(dst)
+	scratch := getTagScratch()
+	defer putTagScratch(scratch)
+	if err := writeHistoLine(context.Background(), &sb, name, centroids, enabledGranularities(hgs), ts, source, scratch.mapTags(nil, tags), defaultSource, newLineConfig(setters)); err != nil {
+		return dst, err
 	}
-	sb.WriteByte(' ')
-	sb.WriteByte('"')
-	sanitizeInternalSb(sb, name)
-	sb.WriteByte('"')
+	observeLine(LineKindHistogram, sb.GetBuf(), len(dst))
+	return sb.GetBuf(), nil
+}
+
+// WriteHistoLine formats the histogram lines like HistoLine into a pooled buffer and writes
+// them to w, returning the number of bytes written. Nothing is written if the lines fail to format.
+func WriteHistoLine(w io.Writer, name string, centroids histogram.Centroids, hgs map[histogram.Granularity]bool, ts int64, source string, tags map[string]string, defaultSource string, setters ...LineOption) (int, error) {
+	sb := internal.GetBuffer()
+	defer internal.PutBuffer(sb)
 
-	sb.WriteString(" source=")
-	sanitizeValueSb(sb, source)
+	scratch := getTagScratch()
+	defer putTagScratch(scratch)
+	if err := writeHistoLine(context.Background(), sb, name, centroids, enabledGranularities(hgs), ts, source, scratch.mapTags(nil, tags), defaultSource, newLineConfig(setters)); err != nil {
+		return 0, err
+	}
+	observeLine(LineKindHistogram, sb.GetBuf(), 0)
+	n, err := sb.WriteTo(w)
+	return int(n), err
+}
 
-	for k, v := range tags {
-		if v == "" {
-			return "", errors.New("histogram tag value cannot be blank")
+// WriteHistoLines writes the histogram lines of a distribution per source to w, in the order
+// of the sources, as if HistoLine was called for each source. The name and tags are sanitized
+// once for all the sources. A source of "" is replaced with defaultSource. Nothing is written
+// if any line fails to format.
+func WriteHistoLines(w io.Writer, name string, perSource map[string]histogram.Centroids, hgs map[histogram.Granularity]bool, ts int64, tags map[string]string, defaultSource string, setters ...LineOption) error {
+	if name == "" {
+		return newFormatError("name", "empty distribution name")
+	}
+	enabled, err := enabledGranularityFlags(enabledGranularities(hgs))
+	if err != nil {
+		return err
+	}
+	cfg := newLineConfig(setters)
+
+	scratch := getTagScratch()
+	defer putTagScratch(scratch)
+	var tagSource TagSource = scratch.mapTags(nil, tags)
+	if cfg.maxPointTags > 0 {
+		if tagSource, err = limitPointTags(tagSource, cfg); err != nil {
+			return err
 		}
-		sb.WriteByte(' ')
-		sb.WriteByte('"')
-		sanitizeInternalSb(sb, k)
-		sb.WriteByte('"')
-		sb.WriteByte('=')
-		sanitizeValueSb(sb, v)
 	}
-	sbBytes := sb.GetBuf()
+	if err := checkNewlines(cfg, name, "", tagSource); err != nil {
+		return err
+	}
+	if err := checkTagKeys(cfg, tagSource); err != nil {
+		return err
+	}
+
+	sb := internal.GetBuffer()
+	defer internal.PutBuffer(sb)
+	body := internal.GetBuffer()
+	defer internal.PutBuffer(body)
+
+	writeName(sb, name, cfg)
+	shared := histoTokens{name: string(sb.GetBuf())}
+	sb.Reset()
+	if err := writeTags(sb, tagSource, errBlankHistoTagKey, errBlankHistoTag, cfg); err != nil {
+		return err
+	}
+	shared.tags = string(sb.GetBuf())
+	sb.Reset()
+
+	sources := make([]string, 0, len(perSource))
+	for source := range perSource {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+
+	// start offsets of each source's lines, observed once the batch is written
+	starts := make([]int, 0, len(sources)+1)
+	for _, source := range sources {
+		body.Reset()
+		if err := writeHistoBody(context.Background(), body, name, perSource[source], ts, source, &noTags, defaultSource, cfg, &shared); err != nil {
+			return err
+		}
+		starts = append(starts, sb.Len())
+		// the body is only read before it is returned to the pool
+		if err := writeHistoGranularities(sb, body.String(), enabled, cfg); err != nil {
+			return err
+		}
+	}
+	if _, err = sb.WriteTo(w); err != nil {
+		return err
+	}
+	buf := sb.GetBuf()
+	starts = append(starts, len(buf))
+	for i := 0; i < len(starts)-1; i++ {
+		observeLine(LineKindHistogram, buf[:starts[i+1]], starts[i])
+	}
+	return nil
+}
+
+// ctxCheckInterval is the number of centroids or span logs written between context checks.
+const ctxCheckInterval = 1024
 
-	sbg := bytes.Buffer{}
+// histogramGranularities lists the granularities in the order their lines are emitted.
+var histogramGranularities = [...]histogram.Granularity{histogram.MINUTE, histogram.HOUR, histogram.DAY}
+
+// enabledGranularities returns the granularities set to true in hgs.
+func enabledGranularities(hgs map[histogram.Granularity]bool) []histogram.Granularity {
+	gran := make([]histogram.Granularity, 0, len(hgs))
 	for hg, on := range hgs {
 		if on {
-			sbg.WriteString(hg.String())
-			sbg.Write(sbBytes)
-			sbg.WriteByte('\n')
+			gran = append(gran, hg)
 		}
 	}
-	return sbg.String(), nil
+	return gran
 }
 
-// Gets a span line in the Wavefront span data format:
-// <tracingSpanName> source=<source> [pointTags] <start_millis> <duration_milli_seconds>
-// Example:
-// "getAllUsers source=localhost traceId=7b3bf470-9456-11e8-9eb6-529269fb1459 spanId=0313bafe-9457-11e8-9eb6-529269fb1459
-//    parent=2f64e538-9457-11e8-9eb6-529269fb1459 application=Wavefront http.method=GET 1533531013 343500"
-func SpanLine(name string, startMillis, durationMillis int64, source, traceId, spanId string, parents, followsFrom []string, tags []SpanTag, spanLogs []SpanLog, defaultSource string) (string, error) {
+func writeHistoLine(ctx context.Context, sb *internal.StringBuilder, name string, centroids histogram.Centroids, gran []histogram.Granularity, ts int64, source string, tags TagSource, defaultSource string, cfg *lineConfig) error {
+	body := internal.GetBuffer()
+	defer internal.PutBuffer(body)
+
+	if err := writeHistoBody(ctx, body, name, centroids, ts, source, tags, defaultSource, cfg, nil); err != nil {
+		return err
+	}
+	enabled, err := enabledGranularityFlags(gran)
+	if err != nil {
+		return err
+	}
+	// the body is only read before it is returned to the pool
+	return writeHistoGranularities(sb, body.String(), enabled, cfg)
+}
+
+func enabledGranularityFlags(gran []histogram.Granularity) ([len(histogramGranularities)]bool, error) {
+	var enabled [len(histogramGranularities)]bool
+	if len(gran) == 0 {
+		return enabled, newFormatError("granularities", "histogram granularities cannot be empty")
+	}
+	for _, hg := range gran {
+		if hg < histogram.MINUTE || hg > histogram.DAY {
+			return enabled, newFormatError("granularities", "unknown histogram granularity %d", hg)
+		}
+		enabled[hg] = true
+	}
+	return enabled, nil
+}
+
+// writeHistoBody writes the part of a histogram line following the granularity prefix.
+// If shared is not nil, its name and tags are written instead of formatting name and tags,
+// which must then already be checked.
+func writeHistoBody(ctx context.Context, body *internal.StringBuilder, name string, centroids histogram.Centroids, ts int64, source string, tags TagSource, defaultSource string, cfg *lineConfig, shared *histoTokens) error {
 	if name == "" {
-		return "", errors.New("empty span name")
+		return newFormatError("name", "empty distribution name")
+	}
+
+	if len(centroids) == 0 {
+		return newFormatError("centroids", "distribution should have at least one centroid")
+	}
+
+	if err := centroids.Validate(); err != nil {
+		return &FormatError{Field: "centroids", Reason: err.Error()}
+	}
+
+	if cfg.histoExtremes != nil {
+		if err := checkHistoExtremes(centroids, cfg.histoExtremes[0], cfg.histoExtremes[1]); err != nil {
+			return err
+		}
+	}
+	if cfg.maxPointTags > 0 {
+		var err error
+		if tags, err = limitPointTags(tags, cfg); err != nil {
+			return err
+		}
+	}
+
+	if cfg.serverTimestamp {
+		ts = 0
+	}
+	if ts < 0 {
+		return newFormatError("timestamp", "timestamp cannot be negative: %d", ts)
+	}
+
+	if err := checkFloatFormat(cfg); err != nil {
+		return err
+	}
+
+	if source == "" {
+		source = defaultSource
+	}
+
+	if err := checkNewlines(cfg, name, source, tags); err != nil {
+		return err
+	}
+	if err := checkTagKeys(cfg, tags); err != nil {
+		return err
+	}
+
+	// Every token of the body is written with its leading space, so the body follows the
+	// granularity prefix directly, with or without a timestamp.
+	size := lineSizeHint(name, source, tags) + 24 + 32*len(centroids)
+	if shared != nil {
+		size += len(shared.name) + len(shared.tags)
+	}
+	body.Grow(size)
+
+	if ts != 0 {
+		body.WriteByte(' ')
+		body.SetBuf(strconv.AppendInt(body.GetBuf(), ts, 10))
+	}
+	if cfg.histoExtremes != nil {
+		writeCentroid(body, 1, cfg.histoExtremes[0], cfg)
+	}
+	if cfg.centroidDigits > 0 {
+		centroids = roundCentroids(centroids, cfg.centroidDigits)
+	}
+	for i, centroid := range centroids.Compact() {
+		if i%ctxCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+		writeCentroid(body, centroid.Count, centroid.Value, cfg)
+	}
+	if cfg.histoExtremes != nil {
+		writeCentroid(body, 1, cfg.histoExtremes[1], cfg)
+	}
+	body.WriteByte(' ')
+	if shared != nil {
+		body.WriteString(shared.name)
+	} else {
+		writeName(body, name, cfg)
+	}
+
+	if err := writeSource(body, source, cfg); err != nil {
+		return err
+	}
+
+	if shared != nil {
+		body.WriteString(shared.tags)
+		return nil
+	}
+	return writeTags(body, tags, errBlankHistoTagKey, errBlankHistoTag, cfg)
+}
+
+// histoTokens holds the formatted name and tags shared by the lines of WriteHistoLines.
+type histoTokens struct {
+	name, tags string
+}
+
+// maxExactInt is the largest integer up to which every integer is exactly a float64.
+const maxExactInt = 1 << 53
+
+// appendValue appends a metric or centroid value like strconv.AppendFloat with the shortest
+// precision. Integer values, such as counts, are appended with the cheaper AppendInt when the
+// output is the same: in the 'f' format, within ±2^53 and except for -0.
+func appendValue(dst []byte, value float64, format byte) []byte {
+	if format == 'f' && value >= -maxExactInt && value <= maxExactInt && value == math.Trunc(value) &&
+		(value != 0 || !math.Signbit(value)) {
+		return strconv.AppendInt(dst, int64(value), 10)
+	}
+	return strconv.AppendFloat(dst, value, format, -1, 64)
+}
+
+// writeCentroid writes a centroid with its leading space.
+func writeCentroid(body *internal.StringBuilder, count int, value float64, cfg *lineConfig) {
+	body.WriteString(" #")
+	body.SetBuf(strconv.AppendInt(body.GetBuf(), int64(count), 10))
+	body.WriteByte(' ')
+	body.SetBuf(appendValue(body.GetBuf(), value, cfg.floatFormat))
+}
+
+// checkHistoExtremes checks that the extremes set with HistogramExtremes bound the centroids.
+func checkHistoExtremes(centroids histogram.Centroids, min, max float64) error {
+	if math.IsNaN(min) || math.IsInf(min, 0) || math.IsNaN(max) || math.IsInf(max, 0) {
+		return newFormatError("centroids", "distribution extremes must be finite")
+	}
+	if min > max {
+		return newFormatError("centroids", "distribution minimum %v is greater than the maximum %v", min, max)
+	}
+	for _, c := range centroids {
+		if c.Value < min || c.Value > max {
+			return newFormatError("centroids", "centroid value %v is outside the extremes [%v, %v]", c.Value, min, max)
+		}
+	}
+	return nil
+}
+
+// roundCentroids returns a copy of the centroids with the values rounded to the given number
+// of significant digits, so close values are merged by Compact.
+func roundCentroids(centroids histogram.Centroids, digits int) histogram.Centroids {
+	rounded := make(histogram.Centroids, len(centroids))
+	for i, c := range centroids {
+		// formatting rounds exactly, unlike scaling by a power of ten
+		v, _ := strconv.ParseFloat(strconv.FormatFloat(c.Value, 'g', digits, 64), 64)
+		rounded[i] = histogram.Centroid{Value: v, Count: c.Count}
+	}
+	return rounded
+}
+
+// writeHistoGranularities writes one line per enabled granularity, in the order minute, hour, day.
+func writeHistoGranularities(sb *internal.StringBuilder, body string, enabled [len(histogramGranularities)]bool, cfg *lineConfig) error {
+	lines := 0
+	for _, hg := range histogramGranularities {
+		if enabled[hg] {
+			if err := checkLineLength(len(hg.String())+len(body), cfg); err != nil {
+				return err
+			}
+			lines++
+		}
+	}
+	sb.Grow(lines * (len(body) + 3))
+	for _, hg := range histogramGranularities {
+		if enabled[hg] {
+			sb.WriteString(hg.String())
+			sb.WriteString(body)
+			sb.WriteByte('\n')
+		}
+	}
+	return nil
+}
+
+// Keys of the tokens written by the formatters ahead of the tags, as in source=<source>.
+const (
+	SourceKey      = "source"
+	TraceIdKey     = "traceId"
+	SpanIdKey      = "spanId"
+	ParentKey      = "parent"
+	FollowsFromKey = "followsFrom"
+	// EventHostKey and EventTagKey precede the source and each tag of an event line.
+	EventHostKey = "host"
+	EventTagKey  = "tag"
+)
+
+// EventPrefix starts every event line.
+const EventPrefix = "@Event"
+
+// Tokens written before the values of the keys above, each with its leading space.
+const (
+	sourceToken      = " " + SourceKey + "="
+	traceIdToken     = " " + TraceIdKey + "="
+	spanIdToken      = " " + SpanIdKey + "="
+	parentToken      = " " + ParentKey + "="
+	followsFromToken = " " + FollowsFromKey + "="
+	eventHostToken   = " " + EventHostKey + "="
+	eventTagToken    = " " + EventTagKey + "="
+)
+
+// SpanLogsTagKey is the span tag marking a span whose logs are sent separately.
+const SpanLogsTagKey = "_spanLogs"
+
+// TruncatedTagsTagKey is the span tag holding the number of tags dropped by TruncateSpanTags.
+const TruncatedTagsTagKey = "_truncatedTags"
+
+// ReservedSpanTagKeys are the keys of the tokens written by the span formatter itself.
+// Span tags with one of these keys are rejected. It must not be modified.
+var ReservedSpanTagKeys = []string{SourceKey, TraceIdKey, SpanIdKey, ParentKey, FollowsFromKey, SpanLogsTagKey, TruncatedTagsTagKey}
+
+// isReservedSpanTagKey reports whether key is one of ReservedSpanTagKeys.
+func isReservedSpanTagKey(key string) bool {
+	switch key {
+	case SourceKey, TraceIdKey, SpanIdKey, ParentKey, FollowsFromKey, SpanLogsTagKey, TruncatedTagsTagKey:
+		return true
+	}
+	return false
+}
+
+// Span tags holding the high and low 64 bits of the trace id, see TraceIdTags.
+const (
+	TraceIdHiTagKey = "traceId.hi"
+	TraceIdLoTagKey = "traceId.lo"
+)
+
+// Gets a span line in the Wavefront span data format:
+// <tracingSpanName> source=<source> [pointTags] <start_millis> <duration_milli_seconds>
+// Example:
+// "getAllUsers source=localhost traceId=7b3bf470-9456-11e8-9eb6-529269fb1459 spanId=0313bafe-9457-11e8-9eb6-529269fb1459
+//    parent=2f64e538-9457-11e8-9eb6-529269fb1459 application=Wavefront http.method=GET 1533531013 343500"
+func SpanLine(name string, startMillis, durationMillis int64, source, traceId, spanId string, parents, followsFrom []string, tags []SpanTag, spanLogs []SpanLog, defaultSource string, setters ...LineOption) (string, error) {
+	sb := internal.GetBuffer()
+	defer internal.PutBuffer(sb)
+
+	if err := writeSpanLine(sb, name, startMillis, durationMillis, source, traceId, spanId, parents, followsFrom, tags, spanLogs, defaultSource, newLineConfig(setters)); err != nil {
+		return "", err
+	}
+	return formatted(LineKindSpan, string(sb.GetBuf())), nil
+}
+
+// SpanLineCtx is like SpanLine with the trace id, span id and links taken from the span context.
+func SpanLineCtx(name string, startMillis, durationMillis int64, source string, sc SpanContext, tags []SpanTag, spanLogs []SpanLog, defaultSource string, setters ...LineOption) (string, error) {
+	return SpanLine(name, startMillis, durationMillis, source, sc.TraceId, sc.SpanId, sc.Parents, sc.FollowsFrom, tags, spanLogs, defaultSource, setters...)
+}
+
+// SpanLineDuration is like SpanLine but takes the start time and duration as time types.
+// The start time is truncated to the millisecond. The duration is rounded to the nearest
+// millisecond, halfway values away from zero, except that a positive duration of less than
+// half a millisecond is reported as 1ms rather than 0 so that short spans are not lost.
+func SpanLineDuration(name string, start time.Time, d time.Duration, source, traceId, spanId string, parents, followsFrom []string, tags []SpanTag, spanLogs []SpanLog, defaultSource string, setters ...LineOption) (string, error) {
+	if start.IsZero() {
+		return "", newFormatError("startMillis", "span start time cannot be zero")
+	}
+	return SpanLine(name, start.UnixNano()/int64(time.Millisecond), spanDurationMillis(d), source, traceId, spanId, parents, followsFrom, tags, spanLogs, defaultSource, setters...)
+}
+
+// spanDurationMillis rounds d to milliseconds as documented on SpanLineDuration.
+func spanDurationMillis(d time.Duration) int64 {
+	if d > 0 && d < time.Millisecond/2 {
+		return 1
+	}
+	return int64(d.Round(time.Millisecond) / time.Millisecond)
+}
+
+// SpanLineWithLogs gets a span line and the JSON line of its span logs, see SpanLogJSON,
+// formatted together so they agree: the SpanLogsTagKey marker is set, whatever the
+// SpanLogsMarker option, exactly when there are span logs, and both lines carry the same ids.
+// Without span logs the span log line is empty. Neither line is returned on error.
+func SpanLineWithLogs(name string, startMillis, durationMillis int64, source, traceId, spanId string, parents, followsFrom []string, tags []SpanTag, spanLogs []SpanLog, defaultSource string, setters ...LineOption) (string, string, error) {
+	cfg := *newLineConfig(setters)
+	// resolve the ids here, so the span logs get the ids written on the span line
+	if cfg.rawTraceId != nil {
+		traceId = formatUUID(*cfg.rawTraceId)
+		cfg.rawTraceId = nil
+	}
+	if spanId == "" && cfg.generateSpanId {
+		spanId = NewSpanID()
+	}
+	hasLogs := len(spanLogs) > 0
+	cfg.spanLogsMarker = &hasLogs
+
+	var spanLogLine string
+	if hasLogs {
+		var err error
+		if spanLogLine, err = SpanLogJSON(canonicalUUID(traceId), canonicalUUID(spanId), spanLogs); err != nil {
+			return "", "", err
+		}
+	}
+
+	sb := internal.GetBuffer()
+	defer internal.PutBuffer(sb)
+
+	if err := writeSpanLine(sb, name, startMillis, durationMillis, source, traceId, spanId, parents, followsFrom, tags, spanLogs, defaultSource, &cfg); err != nil {
+		return "", "", err
+	}
+	return formatted(LineKindSpan, string(sb.GetBuf())), spanLogLine, nil
+}
+
+// SpanDefaults are tags, such as application, service and cluster, and a source applied to
+// every span formatted with SpanLineWithDefaults.
+type SpanDefaults struct {
+	Source string
+	Tags   map[string]string
+}
+
+// SpanLineWithDefaults is like SpanLine with the default tags added to the span tags, except
+// for keys the span already has, and the default source used when source is empty.
+func SpanLineWithDefaults(name string, startMillis, durationMillis int64, source, traceId, spanId string, parents, followsFrom []string, tags []SpanTag, spanLogs []SpanLog, defaults SpanDefaults, setters ...LineOption) (string, error) {
+	return SpanLine(name, startMillis, durationMillis, source, traceId, spanId, parents, followsFrom, withDefaultTags(tags, defaults.Tags), spanLogs, defaults.Source, setters...)
+}
+
+// withDefaultTags returns the span tags followed by the default tags whose key is not already used.
+// The span tags are not modified.
+func withDefaultTags(tags []SpanTag, defaults map[string]string) []SpanTag {
+	if len(defaults) == 0 {
+		return tags
+	}
+	merged := make([]SpanTag, len(tags), len(tags)+len(defaults))
+	copy(merged, tags)
+	for _, k := range sortedKeys(defaults) {
+		found := false
+		for _, tag := range tags {
+			if tag.Key == k {
+				found = true
+				break
+			}
+		}
+		if !found {
+			merged = append(merged, SpanTag{Key: k, Value: defaults[k]})
+		}
+	}
+	return merged
+}
+
+// SpanLineInto appends a span line to dst and returns the extended buffer.
+// It formats and validates exactly like SpanLine. On error dst is returned unchanged.
+func SpanLineInto(dst []byte, name string, startMillis, durationMillis int64, source, traceId, spanId string, parents, followsFrom []string, tags []SpanTag, spanLogs []SpanLog, defaultSource string, setters ...LineOption) ([]byte, error) {
+	var sb internal.StringBuilder
+	sb.SetBuf(dst)
+	if err := writeSpanLine(&sb, name, startMillis, durationMillis, source, traceId, spanId, parents, followsFrom, tags, spanLogs, defaultSource, newLineConfig(setters)); err != nil {
+		return dst, err
+	}
+	observeLine(LineKindSpan, sb.GetBuf(), len(dst))
+	return sb.GetBuf(), nil
+}
+
+// WriteSpanLine formats a span line like SpanLine into a pooled buffer and writes it to w,
+// returning the number of bytes written. Nothing is written if the line fails to format.
+func WriteSpanLine(w io.Writer, name string, startMillis, durationMillis int64, source, traceId, spanId string, parents, followsFrom []string, tags []SpanTag, spanLogs []SpanLog, defaultSource string, setters ...LineOption) (int, error) {
+	sb := internal.GetBuffer()
+	defer internal.PutBuffer(sb)
+
+	if err := writeSpanLine(sb, name, startMillis, durationMillis, source, traceId, spanId, parents, followsFrom, tags, spanLogs, defaultSource, newLineConfig(setters)); err != nil {
+		return 0, err
+	}
+	observeLine(LineKindSpan, sb.GetBuf(), 0)
+	n, err := sb.WriteTo(w)
+	return int(n), err
+}
+
+func writeSpanLine(sb *internal.StringBuilder, name string, startMillis, durationMillis int64, source, traceId, spanId string, parents, followsFrom []string, tags []SpanTag, spanLogs []SpanLog, defaultSource string, cfg *lineConfig) error {
+	if name == "" {
+		return newFormatError("name", "empty span name")
+	}
+	start := sb.Len()
+
+	if source == "" {
+		source = defaultSource
+	}
+
+	// converting the tags to a TagSource allocates, only do it when the checks are enabled
+	if cfg.rejectNewlines {
+		if err := checkNewlines(cfg, name, source, TagList(tags)); err != nil {
+			return err
+		}
+	}
+	if cfg.rejectEqualsInKeys {
+		if err := checkTagKeys(cfg, TagList(tags)); err != nil {
+			return err
+		}
+	}
+	for _, tag := range tags {
+		if isReservedSpanTagKey(tag.Key) {
+			return newFormatError("tags", "span tag key %q is reserved", tag.Key)
+		}
+	}
+
+	if cfg.rawTraceId != nil {
+		traceId = formatUUID(*cfg.rawTraceId)
+	}
+	if spanId == "" && cfg.generateSpanId {
+		spanId = NewSpanID()
+	}
+
+	if startMillis < 0 {
+		return newFormatError("startMillis", "span start time cannot be negative")
+	}
+	if startMillis == 0 {
+		return newFormatError("startMillis", "span start time cannot be zero")
+	}
+	if durationMillis < 0 {
+		return newFormatError("durationMillis", "span duration cannot be negative")
+	}
+
+	if !isUUIDFormat(traceId) {
+		return newFormatError("traceId", "traceId is not in UUID format")
+	}
+	if !isUUIDFormat(spanId) {
+		return newFormatError("spanId", "spanId is not in UUID format")
+	}
+	if cfg.traceIdTags {
+		// first, so they count against the tag limit and truncating drops the caller's tags first
+		hi, lo := traceIdHalves(traceId)
+		tags = append([]SpanTag{{Key: TraceIdHiTagKey, Value: hi}, {Key: TraceIdLoTagKey, Value: lo}}, tags...)
+	}
+	truncatedTags := 0
+	if cfg.maxSpanTags > 0 && len(tags) > cfg.maxSpanTags {
+		if !cfg.truncateSpanTags {
+			return newFormatError("tags", "span has %d tags, more than the maximum of %d", len(tags), cfg.maxSpanTags)
+		}
+		truncatedTags = len(tags) - cfg.maxSpanTags
+		tags = tags[:cfg.maxSpanTags]
+	}
+	for i, parent := range parents {
+		if !isUUIDFormat(parent) {
+			return newFormatError("parents", "parent %d is not in UUID format: %q", i, parent)
+		}
+	}
+	for i, item := range followsFrom {
+		if !isUUIDFormat(item) {
+			return newFormatError("followsFrom", "followsFrom %d is not in UUID format: %q", i, item)
+		}
+	}
+
+	if !cfg.dropBlankTags {
+		for _, tag := range tags {
+			if isBlankTag(tag.Key, tag.Value) {
+				return newFormatError("tags", "span tag key/value cannot be blank")
+			}
+		}
+	}
+
+	sanitizeValueSb(sb, name, cfg)
+	if err := writeSource(sb, source, cfg); err != nil {
+		return err
+	}
+	sb.WriteString(traceIdToken)
+	writeUUID(sb, traceId)
+	sb.WriteString(spanIdToken)
+	writeUUID(sb, spanId)
+
+	for _, parent := range parents {
+		sb.WriteString(parentToken)
+		writeUUID(sb, parent)
+	}
+
+	for _, item := range followsFrom {
+		sb.WriteString(followsFromToken)
+		writeUUID(sb, item)
+	}
+
+	emitSpanLogsMarker := len(spanLogs) > 0
+	if cfg.spanLogsMarker != nil {
+		emitSpanLogsMarker = *cfg.spanLogsMarker
+	}
+	if emitSpanLogsMarker {
+		sb.WriteByte(' ')
+		sb.WriteQuotedRaw(SpanLogsTagKey)
+		sb.WriteByte('=')
+		sb.WriteQuotedRaw("true")
+	}
+	if truncatedTags > 0 {
+		sb.WriteByte(' ')
+		sb.WriteQuotedRaw(TruncatedTagsTagKey)
+		sb.WriteString(`="`)
+		sb.SetBuf(strconv.AppendInt(sb.GetBuf(), int64(truncatedTags), 10))
+		sb.WriteByte('"')
+	}
+
+	if len(tags) > 1 {
+		scratch := getTagScratch()
+		defer putTagScratch(scratch)
+		for _, tag := range scratch.sortedSpanTags(tags) {
+			if cfg.dropBlankTags && isBlankTag(tag.Key, tag.Value) {
+				continue
+			}
+			writeSanitizedTag(sb, tag.Key, spanTagValue(tag.Key, tag.Value), cfg)
+		}
+	} else {
+		for _, tag := range tags {
+			if cfg.dropBlankTags && isBlankTag(tag.Key, tag.Value) {
+				continue
+			}
+			writeTag(sb, tag.Key, spanTagValue(tag.Key, tag.Value), cfg)
+		}
+	}
+	sb.WriteByte(' ')
+	sb.SetBuf(strconv.AppendInt(sb.GetBuf(), startMillis, 10))
+	sb.WriteByte(' ')
+	sb.SetBuf(strconv.AppendInt(sb.GetBuf(), durationMillis, 10))
+	if err := checkLineLength(sb.Len()-start, cfg); err != nil {
+		return err
+	}
+	sb.WriteByte('\n')
+	return nil
+}
+
+// checkFloatFormat checks the configured float format is one the proxy parses: plain decimals
+// or decimal exponents, but not the binary exponents of 'b' and 'x'.
+func checkFloatFormat(cfg *lineConfig) error {
+	switch cfg.floatFormat {
+	case 'f', 'g', 'e':
+		return nil
+	}
+	return newFormatError("value", "unsupported float format %q, expected 'f', 'g' or 'e'", cfg.floatFormat)
+}
+
+// Upper bounds of the formatted value and timestamp, including their leading space.
+const (
+	maxValueSize     = 1 + 24 // -1.2345678901234567e-308
+	maxTimestampSize = 1 + 20 // -9223372036854775808
+)
+
+// MetricLineSize returns an upper bound of the length in bytes of a metric line with the
+// given name, value, source and tags in the default 'f' float format, without formatting it.
+func MetricLineSize(name string, value float64, source string, tags map[string]string) int {
+	// quoted name, value, timestamp, source and the trailing newline
+	n := len(name) + 2 + valueSize(value) + maxTimestampSize + len(sourceToken) + escapedValueSize(source) + 1
+	for k, v := range tags {
+		// ` "k"="v"`
+		n += 4 + len(k) + escapedValueSize(v)
+	}
+	return n
+}
+
+// valueSize returns an upper bound of the length of a value in the 'f' float format, including
+// its leading space. Values between 1e-4 and 1e21 in magnitude fit in maxValueSize, beyond
+// that 'f' spells out every digit and the size is bounded from the binary exponent.
+func valueSize(value float64) int {
+	abs := math.Abs(value)
+	if math.IsInf(abs, 0) || !(abs >= 1e21 || abs < 1e-4 && abs != 0) {
+		return maxValueSize
+	}
+	// abs is in [2^exp, 2^(exp+1)) and 30103/100000 rounds log10(2) up
+	exp := math.Ilogb(abs)
+	if exp > 0 {
+		// space, sign and the integer digits
+		return 2 + (exp+1)*30103/100000 + 1
+	}
+	// space, sign, "0.", the leading zeros and the significant digits
+	return 4 + (-exp)*30103/100000 + 1 + 17
+}
+
+// escapedValueSize returns the length of a value once sanitized, including the quotes.
+func escapedValueSize(s string) int {
+	s = strings.TrimSpace(s)
+	n := len(s) + 2
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\', '"', '\n', '\r', '\t':
+			n++
+		}
+	}
+	return n
+}
+
+// lineSizeHint estimates the bytes taken by the name, source and tags of a line,
+// so the buffer can be grown once up front.
+func lineSizeHint(name, source string, tags TagSource) int {
+	n := len(name) + len(source) + 12
+	for i := 0; i < tags.Len(); i++ {
+		k, v := tags.Tag(i)
+		n += len(k) + len(v) + 6
+	}
+	return n
+}
+
+// checkLineLength checks the length in bytes of a formatted line, without its trailing newline,
+// against the configured maximum.
+func checkLineLength(n int, cfg *lineConfig) error {
+	if cfg.maxLineLength > 0 && n > cfg.maxLineLength {
+		return newFormatError("line", "line exceeds the maximum length of %d bytes: %d", cfg.maxLineLength, n)
+	}
+	return nil
+}
+
+// spanTagValue returns the value to write for a span tag. The values of the boolean
+// error and debug tags are written as lowercase true or false, so for example error=True
+// and error=1 can be queried as error=true.
+func spanTagValue(key, value string) string {
+	if key != "error" && key != "debug" {
+		return value
+	}
+	if b, err := strconv.ParseBool(value); err == nil {
+		return strconv.FormatBool(b)
+	}
+	return value
+}
+
+// checkTagKeys rejects tag keys containing '=' when configured to, instead of silently
+// replacing it on sanitization.
+func checkTagKeys(cfg *lineConfig, tags TagSource) error {
+	if !cfg.rejectEqualsInKeys {
+		return nil
+	}
+	for i := 0; i < tags.Len(); i++ {
+		if k, _ := tags.Tag(i); strings.IndexByte(k, '=') >= 0 {
+			return newFormatError("tags", "tag key %q contains the reserved character '='", k)
+		}
+	}
+	return nil
+}
+
+// checkNewlines rejects a name, source or tag key containing a newline when configured to,
+// instead of silently replacing the newline on sanitization.
+func checkNewlines(cfg *lineConfig, name, source string, tags TagSource) error {
+	if !cfg.rejectNewlines {
+		return nil
+	}
+	if strings.ContainsAny(name, "\r\n") {
+		return newFormatError("name", "name contains a newline: %q", name)
+	}
+	if strings.ContainsAny(source, "\r\n") {
+		return newFormatError("source", "source contains a newline: %q", source)
+	}
+	for i := 0; i < tags.Len(); i++ {
+		if k, _ := tags.Tag(i); strings.ContainsAny(k, "\r\n") {
+			return newFormatError("tags", "tag key contains a newline: %q", k)
+		}
+	}
+	return nil
+}
+
+// writeName writes the sanitized metric or distribution name. The name is quoted unless
+// quoting is configured to be done only when needed and the sanitized name does not need it.
+func writeName(sb *internal.StringBuilder, name string, cfg *lineConfig) {
+	start := sb.Len()
+	sb.WriteByte('"')
+	if cfg.preSanitizedName {
+		if cfg.normalizeDeltaPrefix && strings.HasPrefix(name, internal.AltDeltaPrefix) {
+			sb.WriteString(internal.DeltaPrefix)
+			name = name[len(internal.AltDeltaPrefix):]
+		}
+		sb.WriteString(name)
+	} else {
+		sanitizeNameSb(sb, name, cfg.normalizeDeltaPrefix)
+	}
+	if cfg.quoteNameIfNeeded && !nameNeedsQuoting(sb.GetBuf()[start+1:]) {
+		// drop the opening quote
+		buf := sb.GetBuf()
+		copy(buf[start:], buf[start+1:])
+		sb.SetBuf(buf[:len(buf)-1])
+		return
+	}
+	sb.WriteByte('"')
+}
+
+// nameNeedsQuoting reports whether a sanitized name has to be quoted. Only names made of
+// ASCII letters, digits, '.', '-', '_' and an optional leading '~' are safe unquoted.
+func nameNeedsQuoting(name []byte) bool {
+	for i, c := range name {
+		if c == '~' && i == 0 {
+			continue
+		}
+		if !('0' <= c && c <= '9') && !('A' <= c && c <= 'Z') && !('a' <= c && c <= 'z') && c != '.' && c != '-' && c != '_' {
+			return true
+		}
+	}
+	return len(name) == 0
+}
+
+// writeSource writes the source token, unless it is empty and configured to be omitted, and checks the sanitized source against the configured maximum length.
+func writeSource(sb *internal.StringBuilder, source string, cfg *lineConfig) error {
+	if source == "" && cfg.omitEmptySource {
+		return nil
+	}
+	if cfg.maxSourceLength > 0 {
+		// measure before escaping, an escaped quote is still one character
+		if n := utf8.RuneCountInString(strings.TrimSpace(source)); n > cfg.maxSourceLength {
+			return newFormatError("source", "source exceeds the maximum length of %d characters: %d", cfg.maxSourceLength, n)
+		}
+	}
+	sb.WriteString(sourceToken)
+	sanitizeValueSb(sb, source, cfg)
+	return nil
+}
+
+// FormatError is returned when a metric, distribution, span or event fails validation.
+// Field names the failing input: "name", "value", "timestamp", "source", "tags", "centroids",
+// "granularities", "traceId", "spanId", "parents", "followsFrom", "startMillis", "endMillis",
+// "durationMillis", "spanLogs", "annotations", "body" for HistoLineFromBody or "line" for the formatted
+// line as a whole.
+type FormatError struct {
+	Field  string
+	Reason string
+}
+
+func (e *FormatError) Error() string {
+	return e.Reason
+}
+
+func newFormatError(field, format string, args ...interface{}) *FormatError {
+	return &FormatError{Field: field, Reason: fmt.Sprintf(format, args...)}
+}
+
+var (
+	errBlankMetricTagKey = newFormatError("tags", "metric point tag key cannot be blank")
+	errBlankMetricTag    = newFormatError("tags", "metric point tag value cannot be blank")
+	errBlankHistoTagKey  = newFormatError("tags", "histogram tag key cannot be blank")
+	errBlankHistoTag     = newFormatError("tags", "histogram tag value cannot be blank")
+)
+
+// writeTags writes the point tags in the order of the tag source.
+func writeTags(sb *internal.StringBuilder, tags TagSource, errBlankKey, errBlank error, cfg *lineConfig) error {
+	n := tags.Len()
+	if !cfg.dropBlankTags {
+		for i := 0; i < n; i++ {
+			k, v := tags.Tag(i)
+			if k == "" {
+				return errBlankKey
+			}
+			if isBlankTag(k, v) {
+				return errBlank
+			}
+		}
+	}
+
+	// map tags with more than one entry come with their keys already sanitized for sorting
+	var sorted mapTags
+	if t, ok := tags.(*mapTags); ok {
+		sorted = *t
+	}
+	for i := 0; i < n; i++ {
+		k, v := tags.Tag(i)
+		if cfg.dropBlankTags && isBlankTag(k, v) {
+			continue
+		}
+		switch {
+		case sorted != nil && sorted[i].sanitizedValue:
+			writeTrustedTag(sb, k, v)
+		case sorted != nil && sorted[i].sanitizedKey != "":
+			writeSanitizedTag(sb, sorted[i].sanitizedKey, v, cfg)
+		default:
+			writeTag(sb, k, v, cfg)
+		}
+	}
+	return nil
+}
+
+// isBlankTag reports whether a tag has an empty key or a value that is empty once trimmed.
+func isBlankTag(key, value string) bool {
+	return key == "" || strings.TrimSpace(value) == ""
+}
+
+type mapTag struct {
+	key          string
+	sanitizedKey string
+	value        string
+	// key and value come from SanitizedTags
+	sanitizedValue bool
+}
+
+// mapTags adapts a tag map to TagSource, ordered by sanitized key so the same input always
+// produces a byte-identical line. The value tie-break keeps the order stable when distinct
+// keys sanitize to the same key.
+type mapTags []mapTag
+
+func (t mapTags) Less(i, j int) bool {
+	if t[i].sanitizedKey != t[j].sanitizedKey {
+		return t[i].sanitizedKey < t[j].sanitizedKey
+	}
+	return t[i].value < t[j].value
+}
+
+func (t mapTags) Swap(i, j int) {
+	t[i], t[j] = t[j], t[i]
+}
+
+// noTags is an empty TagSource.
+var noTags mapTags
+
+// spanTagsByKey orders span tags by key.
+type spanTagsByKey []SpanTag
+
+func (t spanTagsByKey) Len() int           { return len(t) }
+func (t spanTagsByKey) Less(i, j int) bool { return t[i].Key < t[j].Key }
+func (t spanTagsByKey) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
+
+// tagScratch holds the tags of a line while they are sorted and written, pooled so that
+// sorting tags does not allocate. The sorted tags must not be used once it is returned to
+// the pool, as their sanitized keys point into keys.
+type tagScratch struct {
+	tags     mapTags
+	spanTags spanTagsByKey
+	// the sanitized keys that differ from their key
+	keys internal.StringBuilder
+}
+
+var tagScratchPool = sync.Pool{
+	New: func() interface{} { return new(tagScratch) },
+}
+
+func getTagScratch() *tagScratch {
+	return tagScratchPool.Get().(*tagScratch)
+}
+
+func putTagScratch(s *tagScratch) {
+	for i := range s.tags {
+		s.tags[i] = mapTag{}
+	}
+	for i := range s.spanTags {
+		s.spanTags[i] = SpanTag{}
+	}
+	s.tags = s.tags[:0]
+	s.spanTags = s.spanTags[:0]
+	s.keys.Reset()
+	tagScratchPool.Put(s)
+}
+
+// sanitizedKey returns the key sanitized, without copying keys that are already legal.
+func (s *tagScratch) sanitizedKey(key string) string {
+	if isLegalName(key) {
+		return key
+	}
+	start := s.keys.Len()
+	sanitizeInternalSb(&s.keys, key)
+	// the keys are only appended to: a key is not overwritten when the buffer grows
+	return s.keys.String()[start:]
+}
+
+// isLegalName reports whether s only has bytes kept as they are by the sanitizer, so that
+// sanitizing it leaves it unchanged.
+func isLegalName(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if !isLegalNameByte(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// mapTags adapts the union of two tag maps, with the point tags taking precedence over
+// common tags with the same key.
+func (s *tagScratch) mapTags(common, point map[string]string) *mapTags {
+	for k, v := range point {
+		s.tags = append(s.tags, mapTag{key: k, value: v})
 	}
+	for k, v := range common {
+		if _, ok := point[k]; !ok {
+			s.tags = append(s.tags, mapTag{key: k, value: v})
+		}
+	}
+	if len(s.tags) <= 1 {
+		// nothing to order, the key is sanitized as it is written
+		return &s.tags
+	}
+	for i := range s.tags {
+		s.tags[i].sanitizedKey = s.sanitizedKey(s.tags[i].key)
+	}
+	sort.Sort(&s.tags)
+	return &s.tags
+}
 
-	if source == "" {
-		source = defaultSource
+// sortedSpanTags returns a copy of the span tags with sanitized keys, stable sorted by key
+// so repeated keys keep the order given by the caller.
+func (s *tagScratch) sortedSpanTags(tags []SpanTag) []SpanTag {
+	for _, tag := range tags {
+		s.spanTags = append(s.spanTags, SpanTag{Key: s.sanitizedKey(tag.Key), Value: tag.Value})
 	}
+	sort.Stable(&s.spanTags)
+	return s.spanTags
+}
 
-	if !isUUIDFormat(traceId) {
-		return "", errors.New("traceId is not in UUID format")
+// MergeTags returns a new map with the common tags and the point tags, the point tags
+// taking precedence. Neither map is modified.
+func MergeTags(common, point map[string]string) map[string]string {
+	merged := make(map[string]string, len(common)+len(point))
+	for k, v := range common {
+		merged[k] = v
 	}
-	if !isUUIDFormat(spanId) {
-		return "", errors.New("spanId is not in UUID format")
+	for k, v := range point {
+		merged[k] = v
 	}
+	return merged
+}
 
-	sb := internal.GetBuffer()
-	defer internal.PutBuffer(sb)
+// SanitizedTags are point tags sanitized once by SanitizeTags, to be reused across many
+// lines without sanitizing them again. They are written as they are, so they can only be
+// built by SanitizeTags; the zero value has no tags.
+type SanitizedTags struct {
+	// ordered by sanitized key, with escaped values
+	tags mapTags
+}
 
-	sanitizeValueSb(sb, name)
-	sb.WriteString(" source=")
-	sanitizeValueSb(sb, source)
-	sb.WriteString(" traceId=")
-	sb.WriteString(traceId)
-	sb.WriteString(" spanId=")
-	sb.WriteString(spanId)
+// Len returns the number of tags.
+func (t SanitizedTags) Len() int {
+	return len(t.tags)
+}
 
-	for _, parent := range parents {
-		sb.WriteString(" parent=")
-		sb.WriteString(parent)
+// SanitizeTags sanitizes the keys and values of tags reused across many lines, such as common
+// labels, and checks that none is blank. Pass the result to MetricLineSanitizedTags.
+// Keys that are the same once sanitized are rejected. Values are escaped with the quote style
+// of the options, which should match the options of the lines the tags are written to.
+func SanitizeTags(tags map[string]string, setters ...LineOption) (SanitizedTags, error) {
+	cfg := newLineConfig(setters)
+	sorted := make(mapTags, 0, len(tags))
+	origKeys := make(map[string]string, len(tags))
+	for k, v := range tags {
+		if k == "" {
+			return SanitizedTags{}, errBlankMetricTagKey
+		}
+		if strings.TrimSpace(v) == "" {
+			return SanitizedTags{}, errBlankMetricTag
+		}
+		key := sanitizeInternal(k)
+		if orig, ok := origKeys[key]; ok {
+			return SanitizedTags{}, newFormatError("tags", "tag keys %q and %q are the same once sanitized", orig, k)
+		}
+		origKeys[key] = k
+		value := sanitizeValue(v, cfg)
+		sorted = append(sorted, mapTag{key: key, sanitizedKey: key, value: value[1 : len(value)-1], sanitizedValue: true})
 	}
+	// sanitized keys are unique
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].key < sorted[j].key
+	})
+	return SanitizedTags{tags: sorted}, nil
+}
 
-	for _, item := range followsFrom {
-		sb.WriteString(" followsFrom=")
-		sb.WriteString(item)
-	}
+func (t mapTags) Len() int {
+	return len(t)
+}
 
-	if len(spanLogs) > 0 {
-		sb.WriteByte(' ')
-		sb.WriteByte('"')
-		sb.WriteString("_spanLogs")
-		sb.WriteByte('"')
-		sb.WriteByte('=')
-		sb.WriteByte('"')
-		sb.WriteString("true")
-		sb.WriteByte('"')
-	}
+func (t mapTags) Tag(i int) (string, string) {
+	return t[i].key, t[i].value
+}
 
-	for _, tag := range tags {
-		if tag.Key == "" || tag.Value == "" {
-			return "", errors.New("span tag key/value cannot be blank")
-		}
-		sb.WriteByte(' ')
-		sb.WriteByte('"')
-		sanitizeInternalSb(sb, tag.Key)
-		sb.WriteByte('"')
-		sb.WriteByte('=')
-		sanitizeValueSb(sb, tag.Value)
-	}
+func writeTag(sb *internal.StringBuilder, key, value string, cfg *lineConfig) {
 	sb.WriteByte(' ')
-	sb.SetBuf(strconv.AppendInt(sb.GetBuf(), startMillis, 10))
+	sb.WriteQuotedSanitized(key, sanitizeInternalSb)
+	sb.WriteByte('=')
+	sanitizeValueSb(sb, value, cfg)
+}
+
+// writeTrustedTag is like writeTag for a key and value from SanitizedTags.
+func writeTrustedTag(sb *internal.StringBuilder, key, value string) {
 	sb.WriteByte(' ')
-	sb.SetBuf(strconv.AppendInt(sb.GetBuf(), durationMillis, 10))
-	sb.WriteByte('\n')
+	sb.WriteQuotedRaw(key)
+	sb.WriteByte('=')
+	sb.WriteQuotedRaw(value)
+}
 
-	return sb.String(), nil
+// writeSanitizedTag is like writeTag for a key that was already sanitized.
+func writeSanitizedTag(sb *internal.StringBuilder, key, value string, cfg *lineConfig) {
+	sb.WriteByte(' ')
+	sb.WriteQuotedRaw(key)
+	sb.WriteByte('=')
+	sanitizeValueSb(sb, value, cfg)
 }
 
 func SpanLogJSON(traceId, spanId string, spanLogs []SpanLog) (string, error) {
@@ -204,19 +1592,172 @@ func SpanLogJSON(traceId, spanId string, spanLogs []SpanLog) (string, error) {
 		SpanId:  spanId,
 		Logs:    spanLogs,
 	}
-	out, err := json.Marshal(l)
-	if err != nil {
+	if err := l.Validate(); err != nil {
 		return "", err
 	}
-	return string(out[:]) + "\n", nil
+	e := spanLogEncoders.Get().(*spanLogEncoder)
+	defer e.release()
+
+	// Encode writes the trailing newline
+	if err := e.enc.Encode(l); err != nil {
+		return "", err
+	}
+	return e.buf.String(), nil
+}
+
+// spanLogsLine validates and formats the span logs the senders send along with a span, or
+// returns "" when there are none. It is called before the span line is sent, which would
+// otherwise be marked with logs that are never sent. The logs carry the ids in the canonical
+// form the span line writes them in, or they would not be joined to the span.
+func spanLogsLine(traceId, spanId string, spanLogs []SpanLog) (string, error) {
+	if len(spanLogs) == 0 {
+		return "", nil
+	}
+	return SpanLogJSON(canonicalUUID(traceId), canonicalUUID(spanId), spanLogs)
+}
+
+// maxPooledSpanLogEncoderCap is the largest buffer kept in the span log encoder pool,
+// so one span with huge logs does not hold on to its memory.
+const maxPooledSpanLogEncoderCap = 64 * 1024
+
+var spanLogEncoders = sync.Pool{
+	New: func() interface{} {
+		e := &spanLogEncoder{}
+		e.enc = json.NewEncoder(&e.buf)
+		return e
+	},
+}
+
+// spanLogEncoder is a pooled JSON encoder writing into its own buffer.
+type spanLogEncoder struct {
+	buf bytes.Buffer
+	enc *json.Encoder
+}
+
+func (e *spanLogEncoder) release() {
+	if e.buf.Cap() > maxPooledSpanLogEncoderCap {
+		return
+	}
+	e.buf.Reset()
+	spanLogEncoders.Put(e)
+}
+
+// WriteSpanLogJSON writes the same JSON object and trailing newline as SpanLogJSON to w,
+// encoding one log entry at a time so memory use does not grow with the number of logs.
+func WriteSpanLogJSON(w io.Writer, traceId, spanId string, spanLogs []SpanLog) error {
+	return WriteSpanLogJSONContext(context.Background(), w, traceId, spanId, spanLogs)
+}
+
+// WriteSpanLogJSONContext is like WriteSpanLogJSON but stops writing and returns the context
+// error once ctx is done. The output is then incomplete.
+func WriteSpanLogJSONContext(ctx context.Context, w io.Writer, traceId, spanId string, spanLogs []SpanLog) error {
+	if err := (SpanLogs{Logs: spanLogs}).Validate(); err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	encode := func(v interface{}) error {
+		if err := enc.Encode(v); err != nil {
+			return err
+		}
+		// Encode terminates every value with a newline
+		buf.Truncate(buf.Len() - 1)
+		return nil
+	}
+	flush := func() error {
+		_, err := w.Write(buf.Bytes())
+		buf.Reset()
+		return err
+	}
+
+	buf.WriteString(`{"traceId":`)
+	if err := encode(traceId); err != nil {
+		return err
+	}
+	buf.WriteString(`,"spanId":`)
+	if err := encode(spanId); err != nil {
+		return err
+	}
+	buf.WriteString(`,"logs":`)
+	if spanLogs == nil {
+		buf.WriteString("null")
+	} else {
+		buf.WriteByte('[')
+		for i, spanLog := range spanLogs {
+			if i%ctxCheckInterval == 0 {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+			}
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := encode(spanLog); err != nil {
+				return err
+			}
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	}
+	buf.WriteString("}\n")
+	return flush()
 }
 
 // EventLine encode the event to a wf proxy format
 // set endMillis to 0 for a 'Instantaneous' event
+// times below 999999999999 are taken as seconds and converted to milliseconds
 func EventLine(name string, startMillis, endMillis int64, source string, tags map[string]string, setters ...event.Option) (string, error) {
+	startMillis, endMillis = adjustStartEndTime(startMillis, endMillis)
+	return EventLineMillis(name, startMillis, endMillis, source, tags, setters...)
+}
+
+// EventLineStrict is like EventLineMillis but rejects the times EventLine would take as
+// seconds, below 999999999999, instead of guessing their unit. This catches seconds passed
+// by mistake, as well as milliseconds small enough to be mistaken for seconds.
+// set endMillis to 0 for a 'Instantaneous' event
+func EventLineStrict(name string, startMillis, endMillis int64, source string, tags map[string]string, setters ...event.Option) (string, error) {
+	start, end := ambiguousEventTimes(startMillis, endMillis)
+	if start {
+		return "", newFormatError("startMillis", "event start time %d may be seconds or milliseconds", startMillis)
+	}
+	if end {
+		return "", newFormatError("endMillis", "event end time %d may be seconds or milliseconds", endMillis)
+	}
+	return EventLineMillis(name, startMillis, endMillis, source, tags, setters...)
+}
+
+// EventLineMillis is like EventLine but always takes the times as epoch milliseconds,
+// without guessing whether they are seconds.
+// set endMillis to 0 for a 'Instantaneous' event
+func EventLineMillis(name string, startMillis, endMillis int64, source string, tags map[string]string, setters ...event.Option) (string, error) {
+	sb := internal.GetBuffer()
+	defer internal.PutBuffer(sb)
+
+	if err := writeEventLine(sb, name, startMillis, endMillis, source, tags, setters); err != nil {
+		return "", err
+	}
+	return formatted(LineKindEvent, string(sb.GetBuf())), nil
+}
+
+// WriteEventLine formats an event line like EventLine into a pooled buffer and writes it to w,
+// returning the number of bytes written. Nothing is written if the line fails to format.
+func WriteEventLine(w io.Writer, name string, startMillis, endMillis int64, source string, tags map[string]string, setters ...event.Option) (int, error) {
 	sb := internal.GetBuffer()
 	defer internal.PutBuffer(sb)
 
+	startMillis, endMillis = adjustStartEndTime(startMillis, endMillis)
+	if err := writeEventLine(sb, name, startMillis, endMillis, source, tags, setters); err != nil {
+		return 0, err
+	}
+	observeLine(LineKindEvent, sb.GetBuf(), 0)
+	n, err := sb.WriteTo(w)
+	return int(n), err
+}
+
+func writeEventLine(sb *internal.StringBuilder, name string, startMillis, endMillis int64, source string, tags map[string]string, setters []event.Option) error {
 	annotations := map[string]string{}
 	l := map[string]interface{}{
 		"annotations": annotations,
@@ -224,10 +1765,16 @@ func EventLine(name string, startMillis, endMillis int64, source string, tags ma
 	for _, set := range setters {
 		set(l)
 	}
+	if err := validateEventSeverity(annotations); err != nil {
+		return err
+	}
+	structuredTags := l[event.StructuredTagsKey] == true
 
-	sb.WriteString("@Event")
+	sb.WriteString(EventPrefix)
 
-	startMillis, endMillis = adjustStartEndTime(startMillis, endMillis)
+	if endMillis == 0 {
+		endMillis = startMillis + 1
+	}
 
 	sb.WriteByte(' ')
 	sb.SetBuf(strconv.AppendInt(sb.GetBuf(), startMillis, 10))
@@ -236,30 +1783,75 @@ func EventLine(name string, startMillis, endMillis int64, source string, tags ma
 	sb.WriteByte(' ')
 	sb.WriteString(strconv.Quote(name))
 
-	for k, v := range annotations {
+	for _, k := range sortedKeys(annotations) {
 		sb.WriteByte(' ')
 		sb.WriteString(k)
 		sb.WriteByte('=')
-		sb.WriteString(strconv.Quote(v))
+		sb.WriteString(strconv.Quote(annotations[k]))
 	}
 
 	if len(source) > 0 {
-		sb.WriteString(" host=")
+		sb.WriteString(eventHostToken)
 		sb.WriteString(strconv.Quote(source))
 	}
 
-	for k, v := range tags {
-		sb.WriteString(" tag=")
-		sb.WriteString(strconv.Quote(fmt.Sprintf("%v: %v", k, v)))
+	for _, k := range sortedKeys(tags) {
+		sb.WriteString(eventTagToken)
+		sb.WriteString(strconv.Quote(eventTagString(k, tags[k], structuredTags)))
 	}
 
 	sb.WriteByte('\n')
-	return sb.String(), nil
+	return nil
 }
 
 // EventLine encode the event to a wf API format
 // set endMillis to 0 for a 'Instantaneous' event
+// times below 999999999999 are taken as seconds and converted to milliseconds
 func EventLineJSON(name string, startMillis, endMillis int64, source string, tags map[string]string, setters ...event.Option) (string, error) {
+	startMillis, endMillis = adjustStartEndTime(startMillis, endMillis)
+	return EventLineJSONMillis(name, startMillis, endMillis, source, tags, setters...)
+}
+
+// EventLineJSONMillis is like EventLineJSON but always takes the times as epoch milliseconds,
+// without guessing whether they are seconds.
+// set endMillis to 0 for a 'Instantaneous' event
+func EventLineJSONMillis(name string, startMillis, endMillis int64, source string, tags map[string]string, setters ...event.Option) (string, error) {
+	l, err := eventJSONObject(name, startMillis, endMillis, source, tags, setters)
+	if err != nil {
+		return "", err
+	}
+
+	jsonData, err := json.Marshal(l)
+	if err != nil {
+		return "", err
+	}
+
+	return string(jsonData), nil
+}
+
+// EventLinesJSON encodes the events as a JSON array of the objects EventLineJSON would
+// produce for each, to create many events with a single API request. An empty slice gives [].
+func EventLinesJSON(events []EventSpec) (string, error) {
+	objects := make([]map[string]interface{}, len(events))
+	for i, e := range events {
+		startMillis, endMillis := adjustStartEndTime(e.StartMillis, e.EndMillis)
+		l, err := eventJSONObject(e.Name, startMillis, endMillis, e.Source, e.Tags, e.Options)
+		if err != nil {
+			return "", err
+		}
+		objects[i] = l
+	}
+
+	jsonData, err := json.Marshal(objects)
+	if err != nil {
+		return "", err
+	}
+
+	return string(jsonData), nil
+}
+
+// eventJSONObject builds the JSON object of an event for the API, times in epoch milliseconds.
+func eventJSONObject(name string, startMillis, endMillis int64, source string, tags map[string]string, setters []event.Option) (map[string]interface{}, error) {
 	annotations := map[string]string{}
 	l := map[string]interface{}{
 		"name":        name,
@@ -269,16 +1861,23 @@ func EventLineJSON(name string, startMillis, endMillis int64, source string, tag
 	for _, set := range setters {
 		set(l)
 	}
+	if err := validateEventSeverity(annotations); err != nil {
+		return nil, err
+	}
+	structuredTags := l[event.StructuredTagsKey] == true
+	delete(l, event.StructuredTagsKey)
 
-	startMillis, endMillis = adjustStartEndTime(startMillis, endMillis)
+	if endMillis == 0 {
+		endMillis = startMillis + 1
+	}
 
 	l["startTime"] = startMillis
 	l["endTime"] = endMillis
 
 	if len(tags) > 0 {
 		var tagList []string
-		for k, v := range tags {
-			tagList = append(tagList, fmt.Sprintf("%v: %v", k, v))
+		for _, k := range sortedKeys(tags) {
+			tagList = append(tagList, eventTagString(k, tags[k], structuredTags))
 		}
 		l["tags"] = tagList
 	}
@@ -286,13 +1885,91 @@ func EventLineJSON(name string, startMillis, endMillis int64, source string, tag
 	if len(source) > 0 {
 		l["hosts"] = []string{source}
 	}
+	return l, nil
+}
 
-	jsonData, err := json.Marshal(l)
-	if err != nil {
-		return "", err
+// eventTagString joins the key and value of an event tag as "key: value". With structured
+// tags, '\' and ':' are escaped with a backslash in the key, so the first unescaped ':' always
+// separates the key from the value, see SplitEventTag.
+func eventTagString(key, value string, structured bool) string {
+	if structured {
+		key = eventTagKeyEscaper.Replace(key)
 	}
+	return key + ": " + value
+}
 
-	return string(jsonData), nil
+var eventTagKeyEscaper = strings.NewReplacer(`\`, `\\`, `:`, `\:`)
+
+// SplitEventTag splits an event tag written with event.StructuredTags into its key and value.
+// It reports false if the tag has no unescaped ": " separator.
+func SplitEventTag(tag string) (key, value string, ok bool) {
+	var sb strings.Builder
+	for i := 0; i < len(tag); i++ {
+		switch c := tag[i]; {
+		case c == '\\' && i+1 < len(tag):
+			i++
+			sb.WriteByte(tag[i])
+		case c == ':':
+			if !strings.HasPrefix(tag[i+1:], " ") {
+				return "", "", false
+			}
+			return sb.String(), tag[i+2:], true
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return "", "", false
+}
+
+// ValidateEventAnnotations checks the well-known annotations set by the given options:
+// the severity must be one of info, warn or severe and the type cannot be blank.
+func ValidateEventAnnotations(setters ...event.Option) error {
+	annotations := map[string]string{}
+	l := map[string]interface{}{
+		"annotations": annotations,
+	}
+	for _, set := range setters {
+		set(l)
+	}
+	return validateEventAnnotations(annotations)
+}
+
+func validateEventAnnotations(annotations map[string]string) error {
+	if err := validateEventSeverity(annotations); err != nil {
+		return err
+	}
+	if t, ok := annotations["type"]; ok && strings.TrimSpace(t) == "" {
+		return newFormatError("annotations", "event type cannot be blank")
+	}
+	return nil
+}
+
+// validateEventSeverity checks the severity annotation, if set, is a known event.SeverityLevel.
+func validateEventSeverity(annotations map[string]string) error {
+	if severity, ok := annotations["severity"]; ok {
+		switch event.SeverityLevel(severity) {
+		case event.SeverityInfo, event.SeverityWarn, event.SeveritySevere:
+		default:
+			return newFormatError("annotations", "invalid event severity %q, expected info, warn or severe", severity)
+		}
+	}
+	return nil
+}
+
+// sortedKeys returns the keys of m in ascending order.
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// ambiguousEventTimes reports which of the event times adjustStartEndTime takes as seconds.
+// A zero end time is not ambiguous, it marks an instantaneous event.
+func ambiguousEventTimes(startMillis, endMillis int64) (start, end bool) {
+	return startMillis < 999999999999, endMillis != 0 && endMillis <= 999999999999
 }
 
 func adjustStartEndTime(startMillis, endMillis int64) (int64, int64) {
@@ -311,8 +1988,18 @@ func adjustStartEndTime(startMillis, endMillis int64) (int64, int64) {
 	return startMillis, endMillis
 }
 
+// isUUIDFormat reports whether str is a UUID, either in the canonical 36 character
+// form or as 32 hex characters without hyphens as emitted by e.g. OpenTelemetry.
 func isUUIDFormat(str string) bool {
 	l := len(str)
+	if l == 32 {
+		for i := 0; i < l; i++ {
+			if !isHexByte(str[i]) {
+				return false
+			}
+		}
+		return true
+	}
 	if l != 36 {
 		return false
 	}
@@ -322,55 +2009,198 @@ func isUUIDFormat(str string) bool {
 			if c != '-' {
 				return false
 			}
-		} else if !(('0' <= c && c <= '9') || ('a' <= c && c <= 'f') || ('A' <= c && c <= 'F')) {
+		} else if !isHexByte(c) {
 			return false
 		}
 	}
 	return true
 }
 
-//Sanitize string of metric name, source and key of tags according to the rule of Wavefront proxy.
-func sanitizeInternal(str string) string {
+func isHexByte(c byte) bool {
+	return ('0' <= c && c <= '9') || ('a' <= c && c <= 'f') || ('A' <= c && c <= 'F')
+}
+
+// writeUUID writes an id accepted by isUUIDFormat in the canonical hyphenated form, in
+// lowercase like NormalizeID. Such an id only holds hex digits and hyphens, so it never
+// needs quoting or escaping.
+func writeUUID(sb *internal.StringBuilder, id string) {
+	hyphenless := len(id) == 32
+	if !hyphenless && !hasUpperHex(id) {
+		sb.WriteString(id)
+		return
+	}
+	buf := sb.GetBuf()
+	for i := 0; i < len(id); i++ {
+		if hyphenless && (i == 8 || i == 12 || i == 16 || i == 20) {
+			buf = append(buf, '-')
+		}
+		c := id[i]
+		if 'A' <= c && c <= 'F' {
+			c += 'a' - 'A'
+		}
+		buf = append(buf, c)
+	}
+	sb.SetBuf(buf)
+}
+
+func hasUpperHex(id string) bool {
+	for i := 0; i < len(id); i++ {
+		if 'A' <= id[i] && id[i] <= 'F' {
+			return true
+		}
+	}
+	return false
+}
+
+// NewSpanID returns a random version 4 UUID in the canonical form accepted as a span or
+// trace id by SpanLine.
+func NewSpanID() string {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		panic("senders: reading random span id: " + err.Error())
+	}
+	id[6] = id[6]&0x0f | 0x40 // version 4
+	id[8] = id[8]&0x3f | 0x80 // RFC 4122 variant
+	return formatUUID(id)
+}
+
+// NormalizeID returns a trace or span id in the canonical form written by SpanLine: lowercase
+// and hyphenated. The id must be a UUID, either hyphenated or as 32 hex characters. Ids
+// differing only in case are the same id, but would otherwise split a trace on the backend.
+func NormalizeID(id string) (string, error) {
+	if !isUUIDFormat(id) {
+		return "", fmt.Errorf("id is not in UUID format: %q", id)
+	}
 	sb := internal.GetBuffer()
 	defer internal.PutBuffer(sb)
+	writeUUID(sb, id)
+	return string(sb.GetBuf()), nil
+}
 
-	// first character can be \u2206 (∆ - INCREMENT) or \u0394 (Δ - GREEK CAPITAL LETTER DELTA)
-	// or ~ tilda character for internal metrics
-	skipHead := 0
-	if strings.HasPrefix(str, internal.DeltaPrefix) {
-		sb.WriteString(internal.DeltaPrefix)
-		skipHead = 3
+// canonicalUUID returns an id accepted by isUUIDFormat in the form written by writeUUID.
+// Other ids are returned unchanged.
+func canonicalUUID(id string) string {
+	if normalized, err := NormalizeID(id); err == nil {
+		return normalized
 	}
-	if strings.HasPrefix(str, internal.AltDeltaPrefix) {
-		sb.WriteString(internal.AltDeltaPrefix)
-		skipHead = 2
+	return id
+}
+
+// formatUUID formats 16 raw bytes in the canonical hyphenated UUID form.
+func formatUUID(id [16]byte) string {
+	var buf [36]byte
+	hex.Encode(buf[0:8], id[0:4])
+	buf[8] = '-'
+	hex.Encode(buf[9:13], id[4:6])
+	buf[13] = '-'
+	hex.Encode(buf[14:18], id[6:8])
+	buf[18] = '-'
+	hex.Encode(buf[19:23], id[8:10])
+	buf[23] = '-'
+	hex.Encode(buf[24:], id[10:])
+	return string(buf[:])
+}
+
+// traceIdHalves returns the high and low 64 bits of an id accepted by isUUIDFormat,
+// each as 16 lowercase hex digits.
+func traceIdHalves(id string) (string, string) {
+	digits := strings.ToLower(strings.Replace(id, "-", "", -1))
+	return digits[:16], digits[16:]
+}
+
+// SanitizeName sanitizes a metric name, source or tag key exactly as it is written by
+// the line formatters, without the surrounding quotes.
+func SanitizeName(s string) string {
+	return sanitizeInternal(s)
+}
+
+// SanitizeValue sanitizes a tag value exactly as it is written by the line formatters with
+// the same options, including the surrounding quotes.
+func SanitizeValue(s string, setters ...LineOption) string {
+	return sanitizeValue(s, newLineConfig(setters))
+}
+
+// UnsanitizeValue is the inverse of SanitizeValue: it removes the surrounding quotes, if any,
+// and unescapes the value. UnsanitizeValue(SanitizeValue(s)) is strings.TrimSpace(s) for any s.
+func UnsanitizeValue(s string) string {
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		s = s[1 : len(s)-1]
 	}
-	// The first char after \u2206 (∆ - INCREMENT) or \u0394 (Δ - GREEK CAPITAL LETTER) (if there is any)
-	// can be ~ tilda character
-	if str[skipHead] == '~' {
-		sb.WriteByte('~')
-		skipHead += 1
+	return valueUnescaper.Replace(s)
+}
+
+// InternalMetricName returns the name with the '~' prefix of internal metrics, unless it already
+// has it. For a delta counter name the '~' goes after the ∆ or Δ prefix, the only order in which
+// the sanitizer keeps both, so the result can also be passed to DeltaCounterLine.
+func InternalMetricName(name string) string {
+	prefix := ""
+	switch {
+	case strings.HasPrefix(name, internal.DeltaPrefix):
+		prefix = internal.DeltaPrefix
+	case strings.HasPrefix(name, internal.AltDeltaPrefix):
+		prefix = internal.AltDeltaPrefix
+	}
+	rest := name[len(prefix):]
+	if strings.HasPrefix(rest, "~") {
+		return name
 	}
+	return prefix + "~" + rest
+}
 
-	for i := skipHead; i < len(str); i++ {
-		cur := str[i]
-		strCur := string(cur)
-		isLegal := true
+// IsLegalNameByte reports whether c is kept as is in metric names, sources and tag keys:
+// a-z, A-Z, 0-9, '_', ',', '-', '.' and '/'. Any other byte is replaced on sanitization,
+// except for a leading delta prefix and '~'.
+func IsLegalNameByte(c byte) bool {
+	return isLegalNameByte(c)
+}
 
-		if !(',' <= cur && cur <= '9') && !('A' <= cur && cur <= 'Z') && !('a' <= cur && cur <= 'z') && cur != '_' {
-			isLegal = false
-		}
-		if isLegal {
-			sb.WriteString(strCur)
-		} else {
-			sb.WriteByte('-')
-		}
+func isLegalNameByte(c byte) bool {
+	return (',' <= c && c <= '9') || ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || c == '_'
+}
+
+// sanitizeReplacement is written in place of every character that is not allowed
+// in metric names, sources and tag keys.
+var sanitizeReplacement byte = '-'
+
+// SetSanitizeReplacement sets the character that replaces characters not allowed in
+// metric names, sources and tag keys. It defaults to '-'. The replacement must be an
+// allowed character itself: a-z, A-Z, 0-9, '_', ',', '-', '.' or '/'.
+// It should be called once during initialization, before any line is formatted.
+func SetSanitizeReplacement(c byte) error {
+	if !isLegalNameByte(c) {
+		return fmt.Errorf("invalid sanitize replacement %q", c)
 	}
-	return sb.String()
+	sanitizeReplacement = c
+	return nil
+}
+
+// sanitizeRunes replaces a whole illegal multibyte rune with a single replacement.
+var sanitizeRunes bool
+
+// SetSanitizeRunes makes sanitization replace each illegal UTF-8 rune with a single replacement
+// character, instead of one per byte: "café" becomes "caf-" rather than "caf--". It is off by
+// default. Like SetSanitizeReplacement it should be called once during initialization.
+func SetSanitizeRunes(enabled bool) {
+	sanitizeRunes = enabled
+}
+
+//Sanitize string of metric name, source and key of tags according to the rule of Wavefront proxy.
+func sanitizeInternal(str string) string {
+	sb := internal.GetBuffer()
+	defer internal.PutBuffer(sb)
+
+	sanitizeInternalSb(sb, str)
+	// copy out, the buffer is reused once returned to the pool
+	return string(sb.GetBuf())
 }
 
 //Sanitize string of metric name, source and key of tags according to the rule of Wavefront proxy.
 func sanitizeInternalSb(sb *internal.StringBuilder, str string) {
+	sanitizeNameSb(sb, str, false)
+}
+
+// sanitizeNameSb is sanitizeInternalSb writing a leading Δ prefix as ∆ if normalizeDelta is set.
+func sanitizeNameSb(sb *internal.StringBuilder, str string, normalizeDelta bool) {
 	// first character can be \u2206 (∆ - INCREMENT) or \u0394 (Δ - GREEK CAPITAL LETTER DELTA)
 	// or ~ tilda character for internal metrics
 	skipHead := 0
@@ -379,48 +2209,67 @@ func sanitizeInternalSb(sb *internal.StringBuilder, str string) {
 		skipHead = 3
 	}
 	if strings.HasPrefix(str, internal.AltDeltaPrefix) {
-		sb.WriteString(internal.AltDeltaPrefix)
+		if normalizeDelta {
+			sb.WriteString(internal.DeltaPrefix)
+		} else {
+			sb.WriteString(internal.AltDeltaPrefix)
+		}
 		skipHead = 2
 	}
 	// The first char after \u2206 (∆ - INCREMENT) or \u0394 (Δ - GREEK CAPITAL LETTER) (if there is any)
 	// can be ~ tilda character
-	if str[skipHead] == '~' {
+	if skipHead < len(str) && str[skipHead] == '~' {
 		sb.WriteByte('~')
 		skipHead += 1
 	}
 
 	for i := skipHead; i < len(str); i++ {
 		cur := str[i]
-		isLegal := true
-
-		if !(',' <= cur && cur <= '9') && !('A' <= cur && cur <= 'Z') && !('a' <= cur && cur <= 'z') && cur != '_' {
-			isLegal = false
-		}
-		if isLegal {
+		if isLegalNameByte(cur) {
 			sb.WriteByte(cur)
-		} else {
-			sb.WriteByte('-')
+			continue
+		}
+		if sanitizeRunes && cur >= utf8.RuneSelf {
+			// skip the rest of the multibyte rune
+			_, size := utf8.DecodeRuneInString(str[i:])
+			i += size - 1
 		}
+		sb.WriteByte(sanitizeReplacement)
 	}
 }
 
+// valueEscaper escapes tag values in a single pass, so escapes are never escaped again.
+var valueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`, "\t", `\t`)
+
+// valueUnescaper reverses valueEscaper, as the line parser does.
+var valueUnescaper = strings.NewReplacer(`\\`, `\`, `\"`, `"`, `\n`, "\n", `\r`, "\r", `\t`, "\t")
+
+// doubledQuoteEscaper is valueEscaper with quotes doubled, for the QuoteDoubled style.
+var doubledQuoteEscaper = strings.NewReplacer(`\`, `\\`, `"`, `""`, "\n", `\n`, "\r", `\r`, "\t", `\t`)
+
 //Sanitize string of tags value, etc.
-func sanitizeValue(str string) string {
-	res := strings.TrimSpace(str)
-	if strings.Contains(str, "\"") {
-		res = strings.ReplaceAll(res, `"`, `\"`)
+func sanitizeValue(str string, cfg *lineConfig) string {
+	if cfg.quoteStyle == QuoteDoubled {
+		return "\"" + doubledQuoteEscaper.Replace(strings.TrimSpace(str)) + "\""
 	}
-
-	return "\"" + strings.ReplaceAll(res, "\n", "\\n") + "\""
+	return "\"" + valueEscaper.Replace(strings.TrimSpace(str)) + "\""
 }
 
 //Sanitize string of tags value, etc.
-func sanitizeValueSb(sb *internal.StringBuilder, str string) {
-	res := strings.TrimSpace(str)
-	if strings.Contains(str, "\"") {
-		res = strings.ReplaceAll(res, `"`, `\"`)
+func sanitizeValueSb(sb *internal.StringBuilder, str string, cfg *lineConfig) {
+	if cfg.quoteStyle == QuoteDoubled {
+		sb.WriteQuotedSanitized(strings.TrimSpace(str), escapeValueDoubledSb)
+		return
 	}
-	sb.WriteByte('"')
-	sb.WriteString(strings.ReplaceAll(res, "\n", "\\n"))
-	sb.WriteByte('"')
+	sb.WriteQuotedSanitized(strings.TrimSpace(str), escapeValueSb)
+}
+
+// escapeValueSb writes a tag value escaped by valueEscaper.
+func escapeValueSb(sb *internal.StringBuilder, str string) {
+	valueEscaper.WriteString(sb, str)
+}
+
+// escapeValueDoubledSb writes a tag value escaped by doubledQuoteEscaper.
+func escapeValueDoubledSb(sb *internal.StringBuilder, str string) {
+	doubledQuoteEscaper.WriteString(sb, str)
 }
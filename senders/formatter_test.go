@@ -1,11 +1,22 @@
 package senders
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
 	"strconv"
+	"strings"
 	"testing"
+	"testing/quick"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/wavefronthq/wavefront-sdk-go/event"
 	"github.com/wavefronthq/wavefront-sdk-go/histogram"
+	"github.com/wavefronthq/wavefront-sdk-go/internal"
 )
 
 var line string
@@ -28,13 +39,319 @@ func TestSanitizeInternal(t *testing.T) {
 		"heartbeat")))
 }
 
+func TestSanitizeNameAndValue(t *testing.T) {
+	assert.Equal(t, "hello-world", SanitizeName("hello world"))
+	assert.Equal(t, "∆~component.heartbeat", SanitizeName("∆~component.heartbeat"))
+	assert.Equal(t, "\"hello \\\"world\\\"\"", SanitizeValue(" hello \"world\" "))
+
+	line, err := MetricLine("my metric!", 1, 0, "src", map[string]string{"k": " v\n1 "}, "")
+	assert.Nil(t, err)
+	assert.Equal(t, "\""+SanitizeName("my metric!")+"\" 1 source="+SanitizeValue("src")+
+		" \"k\"="+SanitizeValue(" v\n1 ")+"\n", line)
+}
+
+func TestSanitizeReplacement(t *testing.T) {
+	defer SetSanitizeReplacement('-')
+
+	assert.Nil(t, SetSanitizeReplacement('_'))
+	assert.Equal(t, "hello_world", sanitizeInternal("hello world"))
+	assert.Equal(t, "∆~component_heartbeat_", sanitizeInternal("∆~component heartbeat!"))
+
+	line, err := MetricLine("foo metric", 1.2, 1533529977, "test_source", map[string]string{"env tag": "test"}, "")
+	assert.Nil(t, err)
+	assert.Equal(t, "\"foo_metric\" 1.2 1533529977 source=\"test_source\" \"env_tag\"=\"test\"\n", line)
+
+	assert.NotNil(t, SetSanitizeReplacement(' '))
+	assert.NotNil(t, SetSanitizeReplacement('"'))
+	assert.Equal(t, "hello_world", sanitizeInternal("hello world"))
+}
+
+func TestIsLegalNameByte(t *testing.T) {
+	legal := "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_,-./"
+	for c := 0; c < 256; c++ {
+		assert.Equal(t, strings.IndexByte(legal, byte(c)) >= 0, IsLegalNameByte(byte(c)), "byte %#x", c)
+		// both sanitizers apply the same rule
+		expected := "-"
+		if IsLegalNameByte(byte(c)) {
+			expected = string([]byte{byte(c)})
+		}
+		if c != '~' {
+			assert.Equal(t, expected, sanitizeInternal(string([]byte{'a', byte(c)}))[1:], "byte %#x", c)
+		}
+	}
+}
+
+func TestSetSanitizeRunes(t *testing.T) {
+	assert.Equal(t, "caf--.latency", SanitizeName("café.latency"))
+
+	SetSanitizeRunes(true)
+	defer SetSanitizeRunes(false)
+	assert.Equal(t, "caf-.latency", SanitizeName("café.latency"))
+	assert.Equal(t, "-.-", SanitizeName("日.本"))
+	assert.Equal(t, "∆~caf-", SanitizeName("∆~café"))
+	assert.Equal(t, "Δ-", SanitizeName("Δ∆"))
+	// invalid UTF-8 is replaced byte by byte
+	assert.Equal(t, "a--", SanitizeName("a\xff\xfe"))
+
+	line, err := MetricLine("café", 1, 0, "test_source", map[string]string{"naïve": "ü"}, "")
+	assert.Nil(t, err)
+	assert.Equal(t, "\"caf-\" 1 source=\"test_source\" \"na-ve\"=\"ü\"\n", line)
+}
+
+func TestSanitizeInternalEdgeCases(t *testing.T) {
+	assert.Equal(t, "", sanitizeInternal(""))
+	assert.Equal(t, "∆", sanitizeInternal("∆"))
+	assert.Equal(t, "Δ", sanitizeInternal("Δ"))
+	assert.Equal(t, "~", sanitizeInternal("~"))
+	assert.Equal(t, "∆~", sanitizeInternal("∆~"))
+	assert.Equal(t, "---", sanitizeInternal("!@#"))
+}
+
 func TestSanitizeValue(t *testing.T) {
-	assert.Equal(t, "\"hello\"", sanitizeValue("hello"))
-	assert.Equal(t, "\"hello world\"", sanitizeValue("hello world"))
-	assert.Equal(t, "\"hello.world\"", sanitizeValue("hello.world"))
-	assert.Equal(t, "\"hello\\\"world\\\"\"", sanitizeValue("hello\"world\""))
-	assert.Equal(t, "\"hello'world\"", sanitizeValue("hello'world"))
-	assert.Equal(t, "\"hello\\nworld\"", sanitizeValue("hello\nworld"))
+	assert.Equal(t, "\"hello\"", sanitizeValue("hello", &defaultLineConfig))
+	assert.Equal(t, "\"hello world\"", sanitizeValue("hello world", &defaultLineConfig))
+	assert.Equal(t, "\"hello.world\"", sanitizeValue("hello.world", &defaultLineConfig))
+	assert.Equal(t, "\"hello\\\"world\\\"\"", sanitizeValue("hello\"world\"", &defaultLineConfig))
+	assert.Equal(t, "\"hello'world\"", sanitizeValue("hello'world", &defaultLineConfig))
+	assert.Equal(t, "\"hello\\nworld\"", sanitizeValue("hello\nworld", &defaultLineConfig))
+
+	assert.Equal(t, `"C:\\temp\\x"`, sanitizeValue(`C:\temp\x`, &defaultLineConfig))
+	assert.Equal(t, `"^\\d+\\.\\\"$"`, sanitizeValue(`^\d+\.\"$`, &defaultLineConfig))
+	assert.Equal(t, `"a\\\nb"`, sanitizeValue("a\\\nb", &defaultLineConfig))
+	assert.Equal(t, `"tab\there\rand\nthere"`, sanitizeValue("tab\there\rand\nthere", &defaultLineConfig))
+
+	sb := internal.GetBuffer()
+	defer internal.PutBuffer(sb)
+	sanitizeValueSb(sb, `C:\temp\x`, &defaultLineConfig)
+	assert.Equal(t, `"C:\\temp\\x"`, string(sb.GetBuf()))
+}
+
+func TestSanitizeValueDoubledQuotes(t *testing.T) {
+	doubled := QuoteEscaping(QuoteDoubled)
+	assert.Equal(t, `"say ""hi"""`, SanitizeValue(` say "hi" `, doubled))
+	assert.Equal(t, `"C:\\x\n""y"""`, SanitizeValue("C:\\x\n\"y\"", doubled))
+	assert.Equal(t, `"say \"hi\""`, SanitizeValue(`say "hi"`, QuoteEscaping(QuoteBackslash)))
+
+	line, err := MetricLine("m", 1, 1533529977, `web "1"`, map[string]string{"q": `a"b`}, "", doubled)
+	assert.Nil(t, err)
+	assert.Equal(t, `"m" 1 1533529977 source="web ""1""" "q"="a""b"`+"\n", line)
+
+	line, err = SpanLine(`get "x"`, 1533531013, 343500, "src", "7b3bf470-9456-11e8-9eb6-529269fb1459",
+		"0313bafe-9457-11e8-9eb6-529269fb1459", nil, nil, []SpanTag{{Key: "k", Value: `"v"`}}, nil, "", doubled)
+	assert.Nil(t, err)
+	assert.Contains(t, line, `"get ""x""" source="src"`)
+	assert.Contains(t, line, `"k"="""v"""`)
+
+	tags, err := SanitizeTags(map[string]string{"q": `a"b`}, doubled)
+	assert.Nil(t, err)
+	line, err = MetricLineSanitizedTags("m", 1, 1533529977, "src", tags, "", doubled)
+	assert.Nil(t, err)
+	assert.Equal(t, `"m" 1 1533529977 source="src" "q"="a""b"`+"\n", line)
+}
+
+func TestUnsanitizeValue(t *testing.T) {
+	for _, s := range []string{"", "hello", " hello world ", `C:\temp\x`, `^\d+\.\"$`, "a\\\nb", "tab\there\rand\nthere", `\`, `"`, `\\n`} {
+		assert.Equal(t, strings.TrimSpace(s), UnsanitizeValue(SanitizeValue(s)), s)
+	}
+	assert.Equal(t, "hello world", UnsanitizeValue("hello world"))
+}
+
+func TestUnsanitizeValueRoundTrip(t *testing.T) {
+	roundTrip := func(s string) bool {
+		return UnsanitizeValue(SanitizeValue(s)) == strings.TrimSpace(s)
+	}
+	assert.Nil(t, quick.Check(roundTrip, &quick.Config{MaxCount: 10000}))
+
+	// random strings rarely contain escapes, so also draw from the characters that need them
+	alphabet := []byte("\\\"\n\r\t ab")
+	escapes := func(idx []uint8) bool {
+		b := make([]byte, len(idx))
+		for i, n := range idx {
+			b[i] = alphabet[int(n)%len(alphabet)]
+		}
+		return roundTrip(string(b))
+	}
+	assert.Nil(t, quick.Check(escapes, &quick.Config{MaxCount: 10000}))
+}
+
+func BenchmarkMetricLineNoTags(b *testing.B) {
+	var r string
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		r, _ = MetricLine("foo.metric", 1.2, 1533529977, "test_source", nil, "")
+	}
+	b.StopTimer()
+	line = r
+}
+
+func TestMetricLinePreSanitized(t *testing.T) {
+	tags := map[string]string{"env": "test"}
+	for _, name := range []string{"request.count", "∆request.count", "~sample"} {
+		expected, err := MetricLine(name, 2, 1533529977, "test_source", tags, "")
+		assert.Nil(t, err)
+		line, err := MetricLinePreSanitized(name, 2, 1533529977, "test_source", tags, "")
+		assert.Nil(t, err)
+		assert.Equal(t, expected, line)
+	}
+
+	line, err := MetricLinePreSanitized("request.count", 2, 1533529977, "test_source", nil, "", QuoteNameIfNeeded())
+	assert.Nil(t, err)
+	assert.Equal(t, "request.count 2 1533529977 source=\"test_source\"\n", line)
+
+	// the name is trusted, not sanitized
+	line, err = MetricLinePreSanitized("request count", 2, 1533529977, "test_source", nil, "")
+	assert.Nil(t, err)
+	assert.Equal(t, "\"request count\" 2 1533529977 source=\"test_source\"\n", line)
+
+	_, err = MetricLinePreSanitized("", 2, 1533529977, "test_source", nil, "")
+	assertFormatError(t, err, "name", "empty metric name")
+}
+
+func BenchmarkMetricLineConstantName(b *testing.B) {
+	var r string
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		r, _ = MetricLine("shop.orders.checkout.requests.count", 123456, 1533529977, "test_source", nil, "")
+	}
+	b.StopTimer()
+	line = r
+}
+
+func BenchmarkMetricLinePreSanitized(b *testing.B) {
+	var r string
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		r, _ = MetricLinePreSanitized("shop.orders.checkout.requests.count", 123456, 1533529977, "test_source", nil, "")
+	}
+	b.StopTimer()
+	line = r
+}
+
+func TestWriteLines(t *testing.T) {
+	var buf bytes.Buffer
+	tags := map[string]string{"env": "test"}
+
+	expected, _ := MetricLine("foo.metric", 1.2, 1533529977, "test_source", tags, "")
+	n, err := WriteMetricLine(&buf, "foo.metric", 1.2, 1533529977, "test_source", tags, "")
+	assert.Nil(t, err)
+	assert.Equal(t, len(expected), n)
+	assert.Equal(t, expected, buf.String())
+
+	buf.Reset()
+	hgs := map[histogram.Granularity]bool{histogram.MINUTE: true, histogram.DAY: true}
+	expected, _ = HistoLine("request.latency", makeCentroids(), hgs, 1533529977, "test_source", tags, "")
+	n, err = WriteHistoLine(&buf, "request.latency", makeCentroids(), hgs, 1533529977, "test_source", tags, "")
+	assert.Nil(t, err)
+	assert.Equal(t, len(expected), n)
+	assert.Equal(t, expected, buf.String())
+
+	buf.Reset()
+	traceId := "7b3bf470-9456-11e8-9eb6-529269fb1459"
+	spanTags := []SpanTag{{Key: "service", Value: "orders"}}
+	expected, _ = SpanLine("order.shirts", 1533531013, 343500, "test_source", traceId, traceId, nil, nil, spanTags, nil, "")
+	n, err = WriteSpanLine(&buf, "order.shirts", 1533531013, 343500, "test_source", traceId, traceId, nil, nil, spanTags, nil, "")
+	assert.Nil(t, err)
+	assert.Equal(t, len(expected), n)
+	assert.Equal(t, expected, buf.String())
+
+	buf.Reset()
+	expected, _ = EventLine("deployment", 1533531013, 0, "test_source", tags, event.Type("deploy"))
+	n, err = WriteEventLine(&buf, "deployment", 1533531013, 0, "test_source", tags, event.Type("deploy"))
+	assert.Nil(t, err)
+	assert.Equal(t, len(expected), n)
+	assert.Equal(t, expected, buf.String())
+
+	buf.Reset()
+	_, err = WriteMetricLine(&buf, "", 1.2, 1533529977, "test_source", tags, "")
+	assert.NotNil(t, err)
+	_, err = WriteHistoLine(&buf, "request.latency", nil, hgs, 1533529977, "test_source", tags, "")
+	assert.NotNil(t, err)
+	_, err = WriteSpanLine(&buf, "", 1533531013, 343500, "test_source", traceId, traceId, nil, nil, nil, nil, "")
+	assert.NotNil(t, err)
+	_, err = WriteEventLine(&buf, "deployment", 1533531013, 0, "test_source", tags, event.Severity("bad"))
+	assert.NotNil(t, err)
+	assert.Equal(t, 0, buf.Len())
+
+	buf.Grow(1024)
+	allocs := testing.AllocsPerRun(100, func() {
+		buf.Reset()
+		WriteMetricLine(&buf, "foo.metric", 1.2, 1533529977, "test_source", nil, "")
+	})
+	// the pooled buffer is written directly
+	assert.Equal(t, float64(0), allocs)
+}
+
+func TestNormalizeDeltaPrefix(t *testing.T) {
+	line, err := MetricLine("\u0394requests", 1, 0, "test_source", nil, "")
+	assert.Nil(t, err)
+	assert.Equal(t, "\"\u0394requests\" 1 source=\"test_source\"\n", line)
+
+	for _, name := range []string{"\u0394requests", "\u2206requests"} {
+		line, err = MetricLine(name, 1, 0, "test_source", nil, "", NormalizeDeltaPrefix())
+		assert.Nil(t, err)
+		assert.Equal(t, "\"\u2206requests\" 1 source=\"test_source\"\n", line)
+
+		line, err = DeltaCounterLine(name, 1, 0, "test_source", nil, "", NormalizeDeltaPrefix())
+		assert.Nil(t, err)
+		assert.Equal(t, "\"\u2206requests\" 1 source=\"test_source\"\n", line)
+
+		line, err = MetricLinePreSanitized(name, 1, 0, "test_source", nil, "", NormalizeDeltaPrefix())
+		assert.Nil(t, err)
+		assert.Equal(t, "\"\u2206requests\" 1 source=\"test_source\"\n", line)
+	}
+
+	line, err = MetricLine("\u0394~requests", 1, 0, "test_source", nil, "", NormalizeDeltaPrefix())
+	assert.Nil(t, err)
+	assert.Equal(t, "\"\u2206~requests\" 1 source=\"test_source\"\n", line)
+
+	// only the leading prefix is a delta prefix, tag keys are not names
+	line, err = MetricLine("requests\u0394", 1, 0, "test_source", map[string]string{"\u0394k": "v"}, "", NormalizeDeltaPrefix())
+	assert.Nil(t, err)
+	assert.Equal(t, "\"requests--\" 1 source=\"test_source\" \"\u0394k\"=\"v\"\n", line)
+
+	line, err = HistoLine("\u0394latency", makeCentroids(), map[histogram.Granularity]bool{histogram.MINUTE: true}, 0, "test_source", nil, "", NormalizeDeltaPrefix())
+	assert.Nil(t, err)
+	assert.Equal(t, "!M #20 30 \"\u2206latency\" source=\"test_source\"\n", line)
+}
+
+func TestAppendValue(t *testing.T) {
+	values := []float64{0, math.Copysign(0, -1), 1, -1, 42, -42, 0.5, 1e15, 1 << 53, -(1 << 53), 1<<53 + 2, 1e21, 1e300, 5e-324}
+	for i := 0; i < 1000; i++ {
+		values = append(values, float64(i*i*i)-5e5, float64(i)/8)
+	}
+	for _, v := range values {
+		for _, format := range []byte{'f', 'g', 'e'} {
+			assert.Equal(t, strconv.FormatFloat(v, format, -1, 64), string(appendValue(nil, v, format)), "%v %c", v, format)
+		}
+	}
+}
+
+func BenchmarkMetricLineInteger(b *testing.B) {
+	var r string
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		r, _ = MetricLine("foo.count", 123456, 1533529977, "test_source", nil, "")
+	}
+	b.StopTimer()
+	line = r
+}
+
+func BenchmarkAppendValue(b *testing.B) {
+	buf := make([]byte, 0, 32)
+	for n := 0; n < b.N; n++ {
+		buf = appendValue(buf[:0], float64(n&0xffff), 'f')
+	}
+}
+
+func BenchmarkAppendFloat(b *testing.B) {
+	buf := make([]byte, 0, 32)
+	for n := 0; n < b.N; n++ {
+		buf = strconv.AppendFloat(buf[:0], float64(n&0xffff), 'f', -1, 64)
+	}
 }
 
 func BenchmarkMetricLine(b *testing.B) {
@@ -42,9 +359,10 @@ func BenchmarkMetricLine(b *testing.B) {
 	value := 1.2
 	ts := int64(1533529977)
 	src := "test_source"
-	tags := map[string]string{"env": "test"}
+	tags := benchmarkTags()
 
 	var r string
+	b.ReportAllocs()
 	b.ResetTimer()
 	for n := 0; n < b.N; n++ {
 		r, _ = MetricLine(name, value, ts, src, tags, "")
@@ -73,21 +391,312 @@ func TestMetricLine(t *testing.T) {
 	assert.Equal(t, expected, line)
 }
 
+func TestMetricLineTagOrder(t *testing.T) {
+	tags := map[string]string{"env": "test", "region": "us-west", "az": "2b", "host name": "h1"}
+	expected := "\"foo.metric\" 1.2 1533529977 source=\"test_source\" \"az\"=\"2b\" \"env\"=\"test\"" +
+		" \"host-name\"=\"h1\" \"region\"=\"us-west\"\n"
+	for i := 0; i < 20; i++ {
+		line, err := MetricLine("foo.metric", 1.2, 1533529977, "test_source", tags, "")
+		assert.Nil(t, err)
+		assert.Equal(t, expected, line)
+	}
+}
+
+func TestMetricLineManySanitizedKeys(t *testing.T) {
+	// enough keys to sanitize to grow the pooled key buffer while the tags are sorted
+	tags := map[string]string{}
+	for i := 0; i < 200; i++ {
+		tags[fmt.Sprintf("key %03d ~", i)] = "v"
+	}
+	line, err := MetricLine("foo.metric", 1, 0, "test_source", tags, "")
+	assert.Nil(t, err)
+
+	var expected strings.Builder
+	expected.WriteString("\"foo.metric\" 1 source=\"test_source\"")
+	for i := 0; i < 200; i++ {
+		fmt.Fprintf(&expected, " \"key-%03d--\"=\"v\"", i)
+	}
+	expected.WriteString("\n")
+	assert.Equal(t, expected.String(), line)
+}
+
+func TestMetricLineTagAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("sync.Pool drops items under the race detector")
+	}
+	tags := map[string]string{"env": "test", "region": "us-west", "host name": "h1"}
+	allocs := testing.AllocsPerRun(100, func() {
+		MetricLine("foo.metric", 1.2, 1533529977, "test_source", tags, "")
+	})
+	// the returned line, the tags are sorted in a pooled buffer
+	assert.Equal(t, float64(1), allocs)
+}
+
+func TestQuoteNameIfNeeded(t *testing.T) {
+	line, err := MetricLine("foo.metric", 1.2, 1533529977, "test_source", nil, "", QuoteNameIfNeeded())
+	assert.Nil(t, err)
+	assert.Equal(t, "foo.metric 1.2 1533529977 source=\"test_source\"\n", line)
+
+	line, err = MetricLine("~foo metric", 1.2, 1533529977, "test_source", nil, "", QuoteNameIfNeeded())
+	assert.Nil(t, err)
+	assert.Equal(t, "~foo-metric 1.2 1533529977 source=\"test_source\"\n", line)
+
+	line, err = MetricLine("foo,metric/1", 1.2, 1533529977, "test_source", nil, "", QuoteNameIfNeeded())
+	assert.Nil(t, err)
+	assert.Equal(t, "\"foo,metric/1\" 1.2 1533529977 source=\"test_source\"\n", line)
+
+	line, err = MetricLine("∆foo.count", 1.2, 1533529977, "test_source", nil, "", QuoteNameIfNeeded())
+	assert.Nil(t, err)
+	assert.Equal(t, "\"∆foo.count\" 1.2 1533529977 source=\"test_source\"\n", line)
+
+	line, err = HistoLine("request.latency", makeCentroids(), map[histogram.Granularity]bool{histogram.MINUTE: true},
+		1533529977, "test_source", nil, "", QuoteNameIfNeeded())
+	assert.Nil(t, err)
+	assert.Equal(t, "!M 1533529977 #20 30 request.latency source=\"test_source\"\n", line)
+
+	buf, err := MetricLineInto([]byte("x "), "foo.metric", 1, 0, "test_source", nil, "", QuoteNameIfNeeded())
+	assert.Nil(t, err)
+	assert.Equal(t, "x foo.metric 1 source=\"test_source\"\n", string(buf))
+}
+
+func TestMetricLineMillis(t *testing.T) {
+	line, err := MetricLine("foo.metric", 1.2, 1533529977, "test_source", nil, "")
+	assert.Nil(t, err)
+	assert.Equal(t, "\"foo.metric\" 1.2 1533529977 source=\"test_source\"\n", line)
+
+	line, err = MetricLineMillis("foo.metric", 1.2, 1533529977123, "test_source", nil, "")
+	assert.Nil(t, err)
+	assert.Equal(t, "\"foo.metric\" 1.2 1533529977123 source=\"test_source\"\n", line)
+
+	line, err = MetricLineMillis("foo.metric", 1.2, 0, "test_source", nil, "")
+	assert.Nil(t, err)
+	assert.Equal(t, "\"foo.metric\" 1.2 source=\"test_source\"\n", line)
+
+	_, err = MetricLineMillis("foo.metric", 1.2, 1533529977, "test_source", nil, "")
+	assertFormatError(t, err, "timestamp", "timestamp 1533529977 looks like epoch seconds, not milliseconds")
+	_, err = MetricLineMillis("foo.metric", 1.2, -1, "test_source", nil, "")
+	assertFormatError(t, err, "timestamp", "timestamp cannot be negative: -1")
+
+	line, err = MetricLine("foo.metric", 1.2, 0, "test_source", nil, "")
+	assert.Nil(t, err)
+	assert.Equal(t, "\"foo.metric\" 1.2 source=\"test_source\"\n", line)
+}
+
+func TestDeltaCounterLine(t *testing.T) {
+	line, err := DeltaCounterLine("foo.count", 3, 0, "test_source", nil, "")
+	assert.Nil(t, err)
+	assert.Equal(t, "\"∆foo.count\" 3 source=\"test_source\"\n", line)
+
+	line, err = DeltaCounterLine("∆foo.count", 3, 0, "test_source", nil, "")
+	assert.Nil(t, err)
+	assert.Equal(t, "\"∆foo.count\" 3 source=\"test_source\"\n", line)
+
+	line, err = DeltaCounterLine("Δfoo.count", 3, 0, "test_source", nil, "")
+	assert.Nil(t, err)
+	assert.Equal(t, "\"Δfoo.count\" 3 source=\"test_source\"\n", line)
+
+	line, err = DeltaCounterLine("~foo.count", 3, 0, "test_source", nil, "")
+	assert.Nil(t, err)
+	assert.Equal(t, "\"∆~foo.count\" 3 source=\"test_source\"\n", line)
+
+	_, err = DeltaCounterLine("", 3, 0, "test_source", nil, "")
+	assert.NotNil(t, err)
+}
+
+func TestMetricLineInvalidValue(t *testing.T) {
+	_, err := MetricLine("foo.metric", math.NaN(), 1533529977, "test_source", nil, "")
+	assert.EqualError(t, err, "metric value is NaN")
+
+	_, err = MetricLine("foo.metric", math.Inf(1), 1533529977, "test_source", nil, "")
+	assert.EqualError(t, err, "metric value is infinite")
+
+	_, err = MetricLine("foo.metric", math.Inf(-1), 1533529977, "test_source", nil, "")
+	assert.EqualError(t, err, "metric value is infinite")
+}
+
+func TestMetricLineTagKeys(t *testing.T) {
+	_, err := MetricLine("foo.metric", 1.2, 1533529977, "test_source", map[string]string{"": "test"}, "")
+	assert.EqualError(t, err, "metric point tag key cannot be blank")
+
+	_, err = MetricLine("foo.metric", 1.2, 1533529977, "test_source", map[string]string{"": "test", "env": "test"}, "")
+	assert.EqualError(t, err, "metric point tag key cannot be blank")
+
+	_, err = HistoLine("request.latency", makeCentroids(), map[histogram.Granularity]bool{histogram.MINUTE: true},
+		1533529977, "test_source", map[string]string{"": "test"}, "")
+	assert.EqualError(t, err, "histogram tag key cannot be blank")
+
+	line, err := MetricLine("foo.metric", 1.2, 1533529977, "test_source", map[string]string{"!@#": "test"}, "")
+	assert.Nil(t, err)
+	assert.Equal(t, "\"foo.metric\" 1.2 1533529977 source=\"test_source\" \"---\"=\"test\"\n", line)
+}
+
+func TestDropBlankTags(t *testing.T) {
+	tags := map[string]string{"env": "test", "empty": "", "spaces": "   ", "": "nokey"}
+	line, err := MetricLine("foo.metric", 1.2, 1533529977, "test_source", tags, "", DropBlankTags())
+	assert.Nil(t, err)
+	assert.Equal(t, "\"foo.metric\" 1.2 1533529977 source=\"test_source\" \"env\"=\"test\"\n", line)
+
+	line, err = MetricLine("foo.metric", 1.2, 1533529977, "test_source", map[string]string{"empty": ""}, "", DropBlankTags())
+	assert.Nil(t, err)
+	assert.Equal(t, "\"foo.metric\" 1.2 1533529977 source=\"test_source\"\n", line)
+
+	line, err = HistoLine("request.latency", makeCentroids(), map[histogram.Granularity]bool{histogram.MINUTE: true},
+		1533529977, "test_source", tags, "", DropBlankTags())
+	assert.Nil(t, err)
+	assert.Equal(t, "!M 1533529977 #20 30 \"request.latency\" source=\"test_source\" \"env\"=\"test\"\n", line)
+
+	traceId := "7b3bf470-9456-11e8-9eb6-529269fb1459"
+	spanTags := []SpanTag{{Key: "env", Value: "test"}, {Key: "empty", Value: " "}, {Key: "", Value: "nokey"}}
+	line, err = SpanLine("order.shirts", 1533531013, 343500, "test_source", traceId, traceId, nil, nil, spanTags, nil, "",
+		DropBlankTags())
+	assert.Nil(t, err)
+	assert.Equal(t, "\"order.shirts\" source=\"test_source\" traceId="+traceId+" spanId="+traceId+
+		" \"env\"=\"test\" 1533531013 343500\n", line)
+
+	_, err = MetricLine("foo.metric", 1.2, 1533529977, "test_source", tags, "")
+	assert.NotNil(t, err)
+	_, err = SpanLine("order.shirts", 1533531013, 343500, "test_source", traceId, traceId, nil, nil, spanTags, nil, "")
+	assert.NotNil(t, err)
+
+	// a whitespace-only value is blank in every line by default
+	_, err = MetricLine("foo.metric", 1.2, 1533529977, "test_source", map[string]string{"spaces": "   "}, "")
+	assert.Equal(t, errBlankMetricTag, err)
+	_, err = HistoLine("request.latency", makeCentroids(), map[histogram.Granularity]bool{histogram.MINUTE: true},
+		1533529977, "test_source", map[string]string{"spaces": "   "}, "")
+	assert.Equal(t, errBlankHistoTag, err)
+	_, err = SpanLine("order.shirts", 1533531013, 343500, "test_source", traceId, traceId, nil, nil,
+		[]SpanTag{{Key: "spaces", Value: "   "}}, nil, "")
+	assertFormatError(t, err, "tags", "span tag key/value cannot be blank")
+}
+
+func TestMetricLineInto(t *testing.T) {
+	buf := []byte("# header\n")
+	buf, err := MetricLineInto(buf, "foo.metric", 1.2, 1533529977, "test_source", map[string]string{"env": "test"}, "")
+	assert.Nil(t, err)
+	buf, err = MetricLineInto(buf, "bar.metric", 3, 0, "", nil, "default")
+	assert.Nil(t, err)
+	expected := "# header\n" +
+		"\"foo.metric\" 1.2 1533529977 source=\"test_source\" \"env\"=\"test\"\n" +
+		"\"bar.metric\" 3 source=\"default\"\n"
+	assert.Equal(t, expected, string(buf))
+
+	out, err := MetricLineInto(buf, "", 1, 0, "", nil, "default")
+	assert.NotNil(t, err)
+	assert.Equal(t, expected, string(out))
+
+	out, err = MetricLineInto(buf, "foo.metric", 1, 0, "", map[string]string{"env": ""}, "default")
+	assert.NotNil(t, err)
+	assert.Equal(t, expected, string(out))
+}
+
+func TestMetricLineNotReused(t *testing.T) {
+	first, err := MetricLine("foo.metric", 1, 0, "test_source", nil, "")
+	assert.Nil(t, err)
+	_, err = MetricLine("bar.metric", 2, 0, "test_source", nil, "")
+	assert.Nil(t, err)
+	assert.Equal(t, "\"foo.metric\" 1 source=\"test_source\"\n", first)
+}
+
 func BenchmarkHistoLine(b *testing.B) {
 	name := "request.latency"
-	centroids := makeCentroids()
-	hgs := map[histogram.Granularity]bool{histogram.MINUTE: true}
+	centroids := make(histogram.Centroids, 100)
+	for i := range centroids {
+		centroids[i] = histogram.Centroid{Value: float64(i) * 1.5, Count: i%7 + 1}
+	}
+	hgs := map[histogram.Granularity]bool{histogram.MINUTE: true, histogram.HOUR: true}
 	ts := int64(1533529977)
 	src := "test_source"
-	tags := map[string]string{"env": "test"}
+	tags := benchmarkTags()
 
 	var r string
+	b.ReportAllocs()
+	b.ResetTimer()
 	for n := 0; n < b.N; n++ {
 		r, _ = HistoLine(name, centroids, hgs, ts, src, tags, "")
 	}
 	line = r
 }
 
+func TestMetricLineJSON(t *testing.T) {
+	line, err := MetricLineJSON("new york.power", 42422.5, 1533531013, "local host", map[string]string{"data center": " dc1 ", "az": `"2b"`})
+	assert.Nil(t, err)
+	assert.Equal(t, `{"name":"new-york.power","value":42422.5,"timestamp":1533531013,"source":"local host","tags":{"az":"\"2b\"","data-center":"dc1"}}`, line)
+
+	line, err = MetricLineJSON("new-york.power", 1, 0, "", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, `{"name":"new-york.power","value":1}`, line)
+
+	_, err = MetricLineJSON("", 1, 0, "", nil)
+	assertFormatError(t, err, "name", "empty metric name")
+	_, err = MetricLineJSON("m", math.NaN(), 0, "", nil)
+	assertFormatError(t, err, "value", "metric value is NaN")
+	_, err = MetricLineJSON("m", 1, -1, "", nil)
+	assertFormatError(t, err, "timestamp", "timestamp cannot be negative: -1")
+	_, err = MetricLineJSON("m", 1, 0, "", map[string]string{"env": " "})
+	assert.Equal(t, errBlankMetricTag, err)
+	_, err = MetricLineJSON("m", 1, 0, "", map[string]string{"a b": "1", "a-b": "2"})
+	assert.NotNil(t, err)
+
+	line, err = MetricLineJSON("m", 1, 0, " web_01.example.com:8080 ", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, `{"name":"m","value":1,"source":"web_01.example.com:8080"}`, line)
+	_, err = MetricLineJSON("m", 1, 0, strings.Repeat("s", 129), nil)
+	assertFormatError(t, err, "source", "source exceeds the maximum length of 128 characters: 129")
+	_, err = MetricLineJSON("m", 1, 0, "source", nil, MaxSourceLength(4))
+	assertFormatError(t, err, "source", "source exceeds the maximum length of 4 characters: 6")
+}
+
+func TestMaxPointTags(t *testing.T) {
+	tags := map[string]string{"region": "us-west", "env": "test", "az": "2b"}
+	_, err := MetricLine("requests", 12, 0, "localhost", tags, "", MaxPointTags(2))
+	assertFormatError(t, err, "tags", "point has 3 tags, more than the maximum of 2")
+
+	line, err := MetricLine("requests", 12, 0, "localhost", tags, "", MaxPointTags(3))
+	assert.Nil(t, err)
+	assert.Equal(t, "\"requests\" 12 source=\"localhost\" \"az\"=\"2b\" \"env\"=\"test\" \"region\"=\"us-west\"\n", line)
+
+	// the tags with the lowest sorted keys are kept
+	for i := 0; i < 10; i++ {
+		line, err = MetricLine("requests", 12, 0, "localhost", tags, "", TruncatePointTags(2))
+		assert.Nil(t, err)
+		assert.Equal(t, "\"requests\" 12 source=\"localhost\" \"az\"=\"2b\" \"env\"=\"test\"\n", line)
+	}
+
+	line, err = MetricLineTags("requests", 12, 0, "localhost", TagList{{Key: "region", Value: "us-west"}, {Key: "env", Value: "test"}}, "", TruncatePointTags(1))
+	assert.Nil(t, err)
+	assert.Equal(t, "\"requests\" 12 source=\"localhost\" \"region\"=\"us-west\"\n", line)
+
+	_, err = HistoLine("request.latency", makeCentroids(), map[histogram.Granularity]bool{histogram.MINUTE: true},
+		1533529977, "test_source", tags, "", MaxPointTags(1))
+	assertFormatError(t, err, "tags", "point has 3 tags, more than the maximum of 1")
+}
+
+func TestMetricTypeTag(t *testing.T) {
+	tags := map[string]string{"env": "test"}
+	line, err := MetricLine("requests", 12, 1533531013, "localhost", tags, "", MetricTypeTag(MetricTypeCounter))
+	assert.Nil(t, err)
+	assert.Equal(t, "\"requests\" 12 1533531013 source=\"localhost\" \"_type\"=\"counter\" \"env\"=\"test\"\n", line)
+
+	line, err = MetricLine("requests", 12, 0, "localhost", nil, "", MetricTypeTag(MetricTypeDelta))
+	assert.Nil(t, err)
+	assert.Equal(t, "\"∆requests\" 12 source=\"localhost\" \"_type\"=\"delta\"\n", line)
+
+	delta, err := DeltaCounterLine("requests", 12, 0, "localhost", nil, "", MetricTypeTag(MetricTypeDelta))
+	assert.Nil(t, err)
+	assert.Equal(t, line, delta)
+
+	_, err = MetricLine("∆requests", 12, 0, "localhost", nil, "", MetricTypeTag(MetricTypeGauge))
+	assertFormatError(t, err, "name", `metric name "∆requests" has the delta prefix but the type is gauge`)
+	_, err = MetricLine("requests", 12, 0, "localhost", map[string]string{"_type": "x"}, "", MetricTypeTag(MetricTypeGauge))
+	assertFormatError(t, err, "tags", `tag key "_type" is reserved for the metric type`)
+	_, err = MetricLine("requests", 12, 0, "localhost", nil, "", MetricTypeTag(MetricType(7)))
+	assertFormatError(t, err, "tags", "invalid metric type 7")
+
+	line, err = MetricLine("requests", 12, 0, "localhost", map[string]string{"_type": "x"}, "")
+	assert.Nil(t, err)
+	assert.Equal(t, "\"requests\" 12 source=\"localhost\" \"_type\"=\"x\"\n", line)
+}
+
 func TestHistoLineCentroidsFormat(t *testing.T) {
 	centroids := histogram.Centroids{
 		{Value: 30.0, Count: 20},
@@ -148,30 +757,244 @@ func TestHistoLine(t *testing.T) {
 		1533529977, "test_source", map[string]string{"env": "test"}, "")
 	expected = "!M 1533529977 #20 30 \"request.latency\" source=\"test_source\" \"env\"=\"test\"\n" +
 		"!H 1533529977 #20 30 \"request.latency\" source=\"test_source\" \"env\"=\"test\"\n"
-	if len(line) != len(expected) {
-		t.Errorf("lines don't match. expected: %s, actual: %s", expected, line)
-	}
+	assert.Nil(t, err)
+	assert.Equal(t, expected, line)
+
+	_, err = HistoLine("request.latency", centroids, map[histogram.Granularity]bool{histogram.MINUTE: false},
+		1533529977, "test_source", map[string]string{"env": "test"}, "")
+	assert.NotNil(t, err)
 }
 
-func BenchmarkSpanLine(b *testing.B) {
-	name := "order.shirts"
-	start := int64(1533531013)
-	dur := int64(343500)
-	src := "test_source"
-	traceId := "7b3bf470-9456-11e8-9eb6-529269fb1459"
+func TestHistoLineInvalidCentroids(t *testing.T) {
+	_, err := HistoLine("request.latency", histogram.Centroids{{Value: 3.2, Count: -5}},
+		map[histogram.Granularity]bool{histogram.MINUTE: true}, 1533529977, "test_source", nil, "")
+	assert.NotNil(t, err)
 
-	var r string
-	for n := 0; n < b.N; n++ {
-		r, _ = SpanLine(name, start, dur, src, traceId, traceId, []string{traceId}, nil, nil, nil, "")
-	}
-	line = r
+	_, err = HistoLine("request.latency", histogram.Centroids{{Value: math.NaN(), Count: 5}},
+		map[histogram.Granularity]bool{histogram.MINUTE: true}, 1533529977, "test_source", nil, "")
+	assert.NotNil(t, err)
 }
 
-func TestSpanLine(t *testing.T) {
-	line, err := SpanLine("order.shirts", 1533531013, 343500, "test_source",
-		"7b3bf470-9456-11e8-9eb6-529269fb1459", "7b3bf470-9456-11e8-9eb6-529269fb1459",
-		[]string{"7b3bf470-9456-11e8-9eb6-529269fb1458"}, nil, nil, nil, "")
-	expected := "\"order.shirts\" source=\"test_source\" traceId=7b3bf470-9456-11e8-9eb6-529269fb1459" +
+func TestServerTimestamp(t *testing.T) {
+	line, err := MetricLine("new-york.power.usage", 42422, 1533531013, "localhost", nil, "", ServerTimestamp())
+	assert.Nil(t, err)
+	assert.Equal(t, "\"new-york.power.usage\" 42422 source=\"localhost\"\n", line)
+
+	// a zero timestamp keeps meaning the same
+	implicit, err := MetricLine("new-york.power.usage", 42422, 0, "localhost", nil, "")
+	assert.Nil(t, err)
+	assert.Equal(t, line, implicit)
+
+	line, err = HistoLine("request.latency", makeCentroids(), map[histogram.Granularity]bool{histogram.MINUTE: true},
+		1533529977, "test_source", nil, "", ServerTimestamp())
+	assert.Nil(t, err)
+	assert.Equal(t, "!M #20 30 \"request.latency\" source=\"test_source\"\n", line)
+}
+
+func TestHistogramExtremes(t *testing.T) {
+	hgs := map[histogram.Granularity]bool{histogram.MINUTE: true}
+	centroids := histogram.Centroids{{Value: 5.1, Count: 10}, {Value: 30, Count: 20}, {Value: 5.1, Count: 5}}
+
+	line, err := HistoLine("request.latency", centroids, hgs, 1533529977, "test_source", nil, "",
+		HistogramExtremes(0.2, 97.5))
+	assert.Nil(t, err)
+	assert.Equal(t, "!M 1533529977 #1 0.2 #15 5.1 #20 30 #1 97.5 \"request.latency\" source=\"test_source\"\n", line)
+
+	// the sentinels are not merged into centroids with the same value
+	line, err = HistoLine("request.latency", centroids, hgs, 1533529977, "test_source", nil, "",
+		HistogramExtremes(5.1, 30))
+	assert.Nil(t, err)
+	assert.Equal(t, "!M 1533529977 #1 5.1 #15 5.1 #20 30 #1 30 \"request.latency\" source=\"test_source\"\n", line)
+
+	_, err = HistoLine("request.latency", centroids, hgs, 1533529977, "test_source", nil, "",
+		HistogramExtremes(10, 97.5))
+	assertFormatError(t, err, "centroids", "centroid value 5.1 is outside the extremes [10, 97.5]")
+	_, err = HistoLine("request.latency", centroids, hgs, 1533529977, "test_source", nil, "",
+		HistogramExtremes(40, 1))
+	assertFormatError(t, err, "centroids", "distribution minimum 40 is greater than the maximum 1")
+	_, err = HistoLine("request.latency", centroids, hgs, 1533529977, "test_source", nil, "",
+		HistogramExtremes(0, math.Inf(1)))
+	assertFormatError(t, err, "centroids", "distribution extremes must be finite")
+}
+
+func TestHistoLineContext(t *testing.T) {
+	hgs := map[histogram.Granularity]bool{histogram.MINUTE: true}
+	line, err := HistoLineContext(context.Background(), "request.latency", makeCentroids(), hgs,
+		1533529977, "test_source", nil, "")
+	assert.Nil(t, err)
+	assert.Equal(t, "!M 1533529977 #20 30 \"request.latency\" source=\"test_source\"\n", line)
+
+	centroids := make(histogram.Centroids, 5000)
+	for i := range centroids {
+		centroids[i] = histogram.Centroid{Value: float64(i), Count: 1}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = HistoLineContext(ctx, "request.latency", centroids, hgs, 1533529977, "test_source", nil, "")
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestHistoLineFromBuckets(t *testing.T) {
+	line, err := HistoLineFromBuckets("request.latency", []float64{10, 20, 40, math.Inf(1)}, []uint64{2, 0, 3, 1},
+		map[histogram.Granularity]bool{histogram.MINUTE: true}, 1533529977, "test_source", nil, "")
+	assert.Nil(t, err)
+	assert.Contains(t, line, " #2 10")
+	assert.Contains(t, line, " #3 30")
+	assert.Contains(t, line, " #1 40")
+
+	_, err = HistoLineFromBuckets("request.latency", []float64{10}, []uint64{0},
+		map[histogram.Granularity]bool{histogram.MINUTE: true}, 1533529977, "test_source", nil, "")
+	assert.NotNil(t, err)
+}
+
+func TestHistoLineGranularities(t *testing.T) {
+	line, err := HistoLineGranularities("request.latency", makeCentroids(),
+		[]histogram.Granularity{histogram.DAY, histogram.MINUTE, histogram.DAY, histogram.HOUR},
+		1533529977, "test_source", nil, "")
+	expected := "!M 1533529977 #20 30 \"request.latency\" source=\"test_source\"\n" +
+		"!H 1533529977 #20 30 \"request.latency\" source=\"test_source\"\n" +
+		"!D 1533529977 #20 30 \"request.latency\" source=\"test_source\"\n"
+	assert.Nil(t, err)
+	assert.Equal(t, expected, line)
+
+	_, err = HistoLineGranularities("request.latency", makeCentroids(), nil, 1533529977, "test_source", nil, "")
+	assert.NotNil(t, err)
+
+	_, err = HistoLineGranularities("request.latency", makeCentroids(), []histogram.Granularity{histogram.Granularity(5)},
+		1533529977, "test_source", nil, "")
+	assert.NotNil(t, err)
+}
+
+func TestHistoLineTagOrder(t *testing.T) {
+	tags := map[string]string{"env": "test", "region": "us-west", "az": "2b"}
+	expected := "!M 1533529977 #20 30 \"request.latency\" source=\"test_source\" \"az\"=\"2b\"" +
+		" \"env\"=\"test\" \"region\"=\"us-west\"\n"
+	for i := 0; i < 20; i++ {
+		line, err := HistoLine("request.latency", makeCentroids(), map[histogram.Granularity]bool{histogram.MINUTE: true},
+			1533529977, "test_source", tags, "")
+		assert.Nil(t, err)
+		assert.Equal(t, expected, line)
+	}
+}
+
+func TestHistoLineInto(t *testing.T) {
+	buf, err := HistoLineInto(nil, "request.latency", makeCentroids(), map[histogram.Granularity]bool{histogram.MINUTE: true},
+		1533529977, "test_source", map[string]string{"env": "test"}, "")
+	assert.Nil(t, err)
+	expected := "!M 1533529977 #20 30 \"request.latency\" source=\"test_source\" \"env\"=\"test\"\n"
+	assert.Equal(t, expected, string(buf))
+
+	out, err := HistoLineInto(buf, "request.latency", nil, map[histogram.Granularity]bool{histogram.MINUTE: true},
+		1533529977, "test_source", nil, "")
+	assert.NotNil(t, err)
+	assert.Equal(t, expected, string(out))
+}
+
+func TestWriteHistoLines(t *testing.T) {
+	hgs := map[histogram.Granularity]bool{histogram.MINUTE: true, histogram.HOUR: true}
+	tags := map[string]string{"env": "test", "region": "us west"}
+	perSource := map[string]histogram.Centroids{
+		"web2": {{Value: 1, Count: 2}},
+		"web1": makeCentroids(),
+		"":     {{Value: 5.5, Count: 1}},
+	}
+
+	var out bytes.Buffer
+	err := WriteHistoLines(&out, "request.latency", perSource, hgs, 1533529977, tags, "dflt")
+	assert.Nil(t, err)
+
+	var expected string
+	for _, source := range []string{"", "web1", "web2"} {
+		line, err := HistoLine("request.latency", perSource[source], hgs, 1533529977, source, tags, "dflt")
+		assert.Nil(t, err)
+		expected += line
+	}
+	assert.Equal(t, expected, out.String())
+
+	out.Reset()
+	perSource["web3"] = nil
+	err = WriteHistoLines(&out, "request.latency", perSource, hgs, 1533529977, tags, "dflt")
+	assertFormatError(t, err, "centroids", "distribution should have at least one centroid")
+	assert.Equal(t, 0, out.Len())
+
+	err = WriteHistoLines(&out, "request.latency", perSource, hgs, 1533529977, map[string]string{"env": ""}, "dflt")
+	assert.Equal(t, errBlankHistoTag, err)
+}
+
+func BenchmarkSpanLine(b *testing.B) {
+	name := "order.shirts"
+	start := int64(1533531013)
+	dur := int64(343500)
+	src := "test_source"
+	traceId := "7b3bf470-9456-11e8-9eb6-529269fb1459"
+	spanId := "0313bafe-9457-11e8-9eb6-529269fb1459"
+	parents := []string{"2f64e538-9457-11e8-9eb6-529269fb1459"}
+	tags := []SpanTag{
+		{Key: "application", Value: "shop"},
+		{Key: "service", Value: "orders"},
+		{Key: "cluster", Value: "us-west-2"},
+		{Key: "http.method", Value: "GET"},
+	}
+	spanLogs := []SpanLog{
+		{Timestamp: 1533531013, Fields: map[string]string{"event": "request"}},
+		{Timestamp: 1533531014, Fields: map[string]string{"event": "query", "db": "orders"}},
+		{Timestamp: 1533531015, Fields: map[string]string{"event": "response"}},
+	}
+
+	var r string
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		r, _ = SpanLine(name, start, dur, src, traceId, spanId, parents, nil, tags, spanLogs, "")
+	}
+	line = r
+}
+
+func BenchmarkEventLine(b *testing.B) {
+	name := "deployment"
+	start := int64(1533531013000)
+	end := int64(1533531073000)
+	src := "test_source"
+	tags := map[string]string{"env": "test", "team": "checkout"}
+
+	var r string
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		r, _ = EventLine(name, start, end, src, tags, event.Severity(event.SeverityInfo), event.Type("deploy"))
+	}
+	line = r
+}
+
+// benchmarkTags returns representative point tags for the formatter benchmarks.
+func benchmarkTags() map[string]string {
+	return map[string]string{
+		"env":         "test",
+		"application": "shop",
+		"service":     "orders",
+		"cluster":     "us-west-2",
+		"version":     "1.4.2",
+	}
+}
+
+func TestSpanLineTagAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("sync.Pool drops items under the race detector")
+	}
+	traceId := "7b3bf470-9456-11e8-9eb6-529269fb1459"
+	tags := []SpanTag{{Key: "service", Value: "orders"}, {Key: "application", Value: "shop"}, {Key: "http method", Value: "GET"}}
+	allocs := testing.AllocsPerRun(100, func() {
+		SpanLine("order.shirts", 1533531013, 343500, "test_source", traceId, traceId, nil, nil, tags, nil, "")
+	})
+	// the returned line, the tags are sorted in a pooled buffer
+	assert.Equal(t, float64(1), allocs)
+}
+
+func TestSpanLine(t *testing.T) {
+	line, err := SpanLine("order.shirts", 1533531013, 343500, "test_source",
+		"7b3bf470-9456-11e8-9eb6-529269fb1459", "7b3bf470-9456-11e8-9eb6-529269fb1459",
+		[]string{"7b3bf470-9456-11e8-9eb6-529269fb1458"}, nil, nil, nil, "")
+	expected := "\"order.shirts\" source=\"test_source\" traceId=7b3bf470-9456-11e8-9eb6-529269fb1459" +
 		" spanId=7b3bf470-9456-11e8-9eb6-529269fb1459 parent=7b3bf470-9456-11e8-9eb6-529269fb1458 1533531013 343500\n"
 	assert.Nil(t, err)
 	assert.Equal(t, expected, line)
@@ -194,6 +1017,962 @@ func TestSpanLine(t *testing.T) {
 	assert.Equal(t, expected, line)
 }
 
+func TestSpanLineTimes(t *testing.T) {
+	traceId := "7b3bf470-9456-11e8-9eb6-529269fb1459"
+
+	_, err := SpanLine("order.shirts", 1533531013, -1, "test_source", traceId, traceId, nil, nil, nil, nil, "")
+	assert.EqualError(t, err, "span duration cannot be negative")
+
+	_, err = SpanLine("order.shirts", 0, 343500, "test_source", traceId, traceId, nil, nil, nil, nil, "")
+	assert.EqualError(t, err, "span start time cannot be zero")
+
+	_, err = SpanLine("order.shirts", -1533531013, 343500, "test_source", traceId, traceId, nil, nil, nil, nil, "")
+	assert.EqualError(t, err, "span start time cannot be negative")
+
+	line, err := SpanLine("order.shirts", 1533531013, 0, "test_source", traceId, traceId, nil, nil, nil, nil, "")
+	assert.Nil(t, err)
+	assert.Equal(t, "\"order.shirts\" source=\"test_source\" traceId="+traceId+" spanId="+traceId+" 1533531013 0\n", line)
+}
+
+func TestSpanLineCtx(t *testing.T) {
+	sc := SpanContext{
+		TraceId: "7b3bf470-9456-11e8-9eb6-529269fb1459",
+		SpanId:  "0313bafe-9457-11e8-9eb6-529269fb1459",
+		Parents: []string{"2f64e538-9457-11e8-9eb6-529269fb1459"},
+	}
+	tags := []SpanTag{{Key: "application", Value: "Wavefront"}}
+	expected, err := SpanLine("getAllUsers", 1533531013, 343500, "localhost", sc.TraceId, sc.SpanId, sc.Parents, nil, tags, nil, "")
+	assert.Nil(t, err)
+
+	line, err := SpanLineCtx("getAllUsers", 1533531013, 343500, "localhost", sc, tags, nil, "")
+	assert.Nil(t, err)
+	assert.Equal(t, expected, line)
+
+	_, err = SpanLineCtx("getAllUsers", 1533531013, 343500, "localhost", SpanContext{TraceId: sc.TraceId}, tags, nil, "")
+	assertFormatError(t, err, "spanId", "spanId is not in UUID format")
+}
+
+func TestSpanLineReservedTagKeys(t *testing.T) {
+	traceId := "7b3bf470-9456-11e8-9eb6-529269fb1459"
+	for _, key := range ReservedSpanTagKeys {
+		_, err := SpanLine("order.shirts", 1533531013, 343500, "test_source", traceId, traceId, nil, nil,
+			[]SpanTag{{Key: "application", Value: "Wavefront"}, {Key: key, Value: "x"}}, nil, "")
+		assertFormatError(t, err, "tags", "span tag key \""+key+"\" is reserved")
+	}
+
+	_, err := SpanLine("order.shirts", 1533531013, 343500, "test_source", traceId, traceId, nil, nil,
+		[]SpanTag{{Key: "sourceType", Value: "x"}}, nil, "")
+	assert.Nil(t, err)
+}
+
+func TestNewSpanID(t *testing.T) {
+	id := NewSpanID()
+	assert.True(t, isUUIDFormat(id), id)
+	assert.Equal(t, byte('4'), id[14])
+	assert.Contains(t, "89ab", string(id[19]))
+	assert.NotEqual(t, id, NewSpanID())
+
+	traceId := "7b3bf470-9456-11e8-9eb6-529269fb1459"
+	_, err := SpanLine("order.shirts", 1533531013, 343500, "test_source", traceId, "", nil, nil, nil, nil, "")
+	assertFormatError(t, err, "spanId", "spanId is not in UUID format")
+
+	line, err := SpanLine("order.shirts", 1533531013, 343500, "test_source", traceId, "", nil, nil, nil, nil, "", GenerateSpanId())
+	assert.Nil(t, err)
+	fields := strings.Fields(line)
+	assert.True(t, strings.HasPrefix(fields[3], "spanId="))
+	assert.True(t, isUUIDFormat(strings.TrimPrefix(fields[3], "spanId=")), line)
+}
+
+func TestSpanLineWithLogs(t *testing.T) {
+	traceId := "7b3bf470-9456-11e8-9eb6-529269fb1459"
+	logs := []SpanLog{{Timestamp: 1533531013, Fields: map[string]string{"event": "error"}}}
+
+	line, logLine, err := SpanLineWithLogs("order.shirts", 1533531013, 343500, "test_source", "7b3bf470945611e89eb6529269fb1459", traceId,
+		nil, nil, nil, logs, "", SpanLogsMarker(false))
+	assert.Nil(t, err)
+	assert.Equal(t, "\"order.shirts\" source=\"test_source\" traceId="+traceId+" spanId="+traceId+
+		" \"_spanLogs\"=\"true\" 1533531013 343500\n", line)
+	expected, err := SpanLogJSON(traceId, traceId, logs)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, logLine)
+
+	line, logLine, err = SpanLineWithLogs("order.shirts", 1533531013, 343500, "test_source", traceId, traceId,
+		nil, nil, nil, nil, "", SpanLogsMarker(true))
+	assert.Nil(t, err)
+	assert.NotContains(t, line, SpanLogsTagKey)
+	assert.Equal(t, "", logLine)
+
+	line, logLine, err = SpanLineWithLogs("order.shirts", 1533531013, 343500, "test_source", traceId, traceId,
+		nil, nil, nil, []SpanLog{{Timestamp: 1533531013}}, "")
+	assert.NotNil(t, err)
+	assert.Equal(t, "", line)
+	assert.Equal(t, "", logLine)
+}
+
+func TestNormalizeID(t *testing.T) {
+	const normalized = "7b3bf470-9456-11e8-9eb6-529269fb1459"
+	for _, id := range []string{normalized, "7B3BF470-9456-11E8-9EB6-529269FB1459", "7b3bf470945611e89eb6529269fb1459", "7B3bf470945611E89eb6529269FB1459"} {
+		got, err := NormalizeID(id)
+		assert.Nil(t, err)
+		assert.Equal(t, normalized, got, id)
+	}
+	_, err := NormalizeID("7b3bf470-9456")
+	assert.EqualError(t, err, `id is not in UUID format: "7b3bf470-9456"`)
+
+	line, err := SpanLine("order.shirts", 1533531013, 343500, "test_source", "7B3BF470-9456-11E8-9EB6-529269FB1459", "7B3BF470945611E89EB6529269FB1459",
+		[]string{"7B3BF470-9456-11E8-9EB6-529269FB1459"}, nil, nil, nil, "")
+	assert.Nil(t, err)
+	assert.Equal(t, "\"order.shirts\" source=\"test_source\" traceId="+normalized+" spanId="+normalized+" parent="+normalized+" 1533531013 343500\n", line)
+}
+
+func TestSpanLineDuration(t *testing.T) {
+	traceId := "7b3bf470-9456-11e8-9eb6-529269fb1459"
+	start := time.Unix(1533531013, 999999)
+	prefix := "\"order.shirts\" source=\"test_source\" traceId=" + traceId + " spanId=" + traceId + " 1533531013000 "
+
+	for d, millis := range map[time.Duration]string{
+		343500 * time.Millisecond: "343500",
+		1499 * time.Microsecond:   "1",
+		1500 * time.Microsecond:   "2",
+		100 * time.Microsecond:    "1",
+		0:                         "0",
+	} {
+		line, err := SpanLineDuration("order.shirts", start, d, "test_source", traceId, traceId, nil, nil, nil, nil, "")
+		assert.Nil(t, err)
+		assert.Equal(t, prefix+millis+"\n", line, d.String())
+	}
+
+	_, err := SpanLineDuration("order.shirts", start, -time.Millisecond, "test_source", traceId, traceId, nil, nil, nil, nil, "")
+	assertFormatError(t, err, "durationMillis", "span duration cannot be negative")
+	_, err = SpanLineDuration("order.shirts", time.Time{}, time.Millisecond, "test_source", traceId, traceId, nil, nil, nil, nil, "")
+	assertFormatError(t, err, "startMillis", "span start time cannot be zero")
+}
+
+func TestSpanLogsMarker(t *testing.T) {
+	traceId := "7b3bf470-9456-11e8-9eb6-529269fb1459"
+	logs := []SpanLog{{Timestamp: 1533531013, Fields: map[string]string{"event": "error"}}}
+	withMarker := "\"order.shirts\" source=\"test_source\" traceId=" + traceId + " spanId=" + traceId +
+		" \"_spanLogs\"=\"true\" 1533531013 343500\n"
+	withoutMarker := "\"order.shirts\" source=\"test_source\" traceId=" + traceId + " spanId=" + traceId +
+		" 1533531013 343500\n"
+
+	line, err := SpanLine("order.shirts", 1533531013, 343500, "test_source", traceId, traceId, nil, nil, nil, logs, "")
+	assert.Nil(t, err)
+	assert.Equal(t, withMarker, line)
+
+	line, err = SpanLine("order.shirts", 1533531013, 343500, "test_source", traceId, traceId, nil, nil, nil, logs, "",
+		SpanLogsMarker(false))
+	assert.Nil(t, err)
+	assert.Equal(t, withoutMarker, line)
+
+	line, err = SpanLine("order.shirts", 1533531013, 343500, "test_source", traceId, traceId, nil, nil, nil, nil, "",
+		SpanLogsMarker(true))
+	assert.Nil(t, err)
+	assert.Equal(t, withMarker, line)
+}
+
+func TestSpanLineLinks(t *testing.T) {
+	traceId := "7b3bf470-9456-11e8-9eb6-529269fb1459"
+
+	_, err := SpanLine("order.shirts", 1533531013, 343500, "test_source", traceId, traceId,
+		[]string{traceId, "7b3bf470-9456"}, nil, nil, nil, "")
+	assert.EqualError(t, err, "parent 1 is not in UUID format: \"7b3bf470-9456\"")
+
+	_, err = SpanLine("order.shirts", 1533531013, 343500, "test_source", traceId, traceId,
+		nil, []string{"7b3bf470-9456-11e8-9eb6-529269fb145g"}, nil, nil, "")
+	assert.EqualError(t, err, "followsFrom 0 is not in UUID format: \"7b3bf470-9456-11e8-9eb6-529269fb145g\"")
+
+	// ids that would need escaping or corrupt the line are rejected, naming the link and its index
+	for _, id := range []string{"{7b3bf470-9456-11e8-9eb6-529269fb1459}", "7b3bf470-9456-11e8-9eb6-529269fb14 9", "7b3bf470\"9456-11e8-9eb6-529269fb1459"} {
+		_, err = SpanLine("order.shirts", 1533531013, 343500, "test_source", traceId, traceId,
+			[]string{traceId, traceId, id}, nil, nil, nil, "")
+		assertFormatError(t, err, "parents", "parent 2 is not in UUID format: "+strconv.Quote(id))
+
+		_, err = SpanLine("order.shirts", 1533531013, 343500, "test_source", traceId, traceId,
+			nil, []string{id}, nil, nil, "")
+		assertFormatError(t, err, "followsFrom", "followsFrom 0 is not in UUID format: "+strconv.Quote(id))
+	}
+
+	line, err := SpanLine("order.shirts", 1533531013, 343500, "test_source", traceId, traceId,
+		[]string{"0313bafe945711e89eb6529269fb1459"}, nil, nil, nil, "")
+	assert.Nil(t, err)
+	assert.Contains(t, line, " parent=0313bafe-9457-11e8-9eb6-529269fb1459 ")
+}
+
+func TestSpanLineHyphenlessIds(t *testing.T) {
+	line, err := SpanLine("order.shirts", 1533531013, 343500, "test_source",
+		"7b3bf470945611e89eb6529269fb1459", "0313bafe945711e89eb6529269fb1459", nil, nil, nil, nil, "")
+	expected := "\"order.shirts\" source=\"test_source\" traceId=7b3bf470-9456-11e8-9eb6-529269fb1459" +
+		" spanId=0313bafe-9457-11e8-9eb6-529269fb1459 1533531013 343500\n"
+	assert.Nil(t, err)
+	assert.Equal(t, expected, line)
+}
+
+func TestSpanLineTagOrder(t *testing.T) {
+	tags := []SpanTag{{Key: "user", Value: "foo"}, {Key: "env", Value: "test"}, {Key: "user", Value: "bar"}}
+	line, err := SpanLine("order.shirts", 1533531013, 343500, "test_source",
+		"7b3bf470-9456-11e8-9eb6-529269fb1459", "7b3bf470-9456-11e8-9eb6-529269fb1459", nil, nil, tags, nil, "")
+	expected := "\"order.shirts\" source=\"test_source\" traceId=7b3bf470-9456-11e8-9eb6-529269fb1459" +
+		" spanId=7b3bf470-9456-11e8-9eb6-529269fb1459 \"env\"=\"test\" \"user\"=\"foo\" \"user\"=\"bar\" 1533531013 343500\n"
+	assert.Nil(t, err)
+	assert.Equal(t, expected, line)
+	assert.Equal(t, "user", tags[0].Key, "caller tags must not be reordered")
+}
+
+func TestSpanLineInto(t *testing.T) {
+	buf, err := SpanLineInto([]byte("x\n"), "order.shirts", 1533531013, 343500, "test_source",
+		"7b3bf470-9456-11e8-9eb6-529269fb1459", "7b3bf470-9456-11e8-9eb6-529269fb1459", nil, nil, nil, nil, "")
+	assert.Nil(t, err)
+	expected := "x\n\"order.shirts\" source=\"test_source\" traceId=7b3bf470-9456-11e8-9eb6-529269fb1459" +
+		" spanId=7b3bf470-9456-11e8-9eb6-529269fb1459 1533531013 343500\n"
+	assert.Equal(t, expected, string(buf))
+
+	out, err := SpanLineInto(buf, "order.shirts", 1533531013, 343500, "test_source",
+		"not-a-uuid", "7b3bf470-9456-11e8-9eb6-529269fb1459", nil, nil, nil, nil, "")
+	assert.NotNil(t, err)
+	assert.Equal(t, expected, string(out))
+}
+
+func TestSpanLogJSONPooled(t *testing.T) {
+	traceId := "7b3bf470-9456-11e8-9eb6-529269fb1459"
+	spanId := "0313bafe-9457-11e8-9eb6-529269fb1459"
+	for _, logs := range [][]SpanLog{
+		nil,
+		{},
+		{{Timestamp: 1533531013, Fields: map[string]string{"msg": "<b>a & b</b>", "z": "\u2028"}}},
+		{{Timestamp: 1, Fields: map[string]string{"event": "start"}}, {Timestamp: 2, Fields: map[string]string{"event": "error"}}},
+	} {
+		out, err := json.Marshal(SpanLogs{TraceId: traceId, SpanId: spanId, Logs: logs})
+		assert.Nil(t, err)
+		// repeated calls reuse the pooled buffer
+		for i := 0; i < 2; i++ {
+			line, err := SpanLogJSON(traceId, spanId, logs)
+			assert.Nil(t, err)
+			assert.Equal(t, string(out)+"\n", line)
+		}
+	}
+}
+
+func TestSpanLogsValidate(t *testing.T) {
+	traceId := "7b3bf470-9456-11e8-9eb6-529269fb1459"
+	fields := map[string]string{"event": "error"}
+	assert.Nil(t, SpanLogs{}.Validate())
+	assert.Nil(t, SpanLogs{Logs: []SpanLog{{Timestamp: 1533531013, Fields: fields}}}.Validate())
+
+	for _, logs := range [][]SpanLog{
+		{{Timestamp: 0, Fields: fields}},
+		{{Timestamp: -1, Fields: fields}},
+		{{Timestamp: 1533531013, Fields: fields}, {Timestamp: 1533531014}},
+		{{Timestamp: 1533531013, Fields: map[string]string{}}},
+	} {
+		err := SpanLogs{Logs: logs}.Validate()
+		assertFormatError(t, err, "spanLogs", err.Error())
+
+		_, err = SpanLogJSON(traceId, traceId, logs)
+		assert.NotNil(t, err)
+		var buf bytes.Buffer
+		assert.NotNil(t, WriteSpanLogJSON(&buf, traceId, traceId, logs))
+		assert.Equal(t, 0, buf.Len())
+	}
+	err := SpanLogs{Logs: []SpanLog{{Timestamp: 1533531013, Fields: fields}, {Timestamp: 1533531014}}}.Validate()
+	assert.EqualError(t, err, "span log 1 has no fields")
+}
+
+func TestNewSpanLog(t *testing.T) {
+	fields := map[string]string{"event": "error"}
+	log, err := NewSpanLog(1533531013, fields)
+	assert.Nil(t, err)
+	assert.Equal(t, SpanLog{Timestamp: 1533531013, Fields: fields}, log)
+	assert.Nil(t, SpanLogs{Logs: []SpanLog{log}}.Validate())
+
+	_, err = NewSpanLog(0, fields)
+	assertFormatError(t, err, "spanLogs", "span log has no positive timestamp: 0")
+	_, err = NewSpanLog(-1, fields)
+	assertFormatError(t, err, "spanLogs", "span log has no positive timestamp: -1")
+	_, err = NewSpanLog(1533531013, nil)
+	assertFormatError(t, err, "spanLogs", "span log has no fields")
+	_, err = NewSpanLog(1533531013, map[string]string{})
+	assertFormatError(t, err, "spanLogs", "span log has no fields")
+}
+
+func TestWriteSpanLogJSON(t *testing.T) {
+	traceId := "7b3bf470-9456-11e8-9eb6-529269fb1459"
+	spanId := "0313bafe-9457-11e8-9eb6-529269fb1459"
+	cases := [][]SpanLog{
+		nil,
+		{},
+		{{Timestamp: 1533531013, Fields: map[string]string{"event": "error", "message": "<a> & \"b\""}}},
+		{
+			{Timestamp: 1533531013, Fields: map[string]string{"event": "start"}},
+			{Timestamp: 1533531014, Fields: map[string]string{"event": "retry"}},
+			{Timestamp: 1533531015, Fields: map[string]string{"b": "2", "a": "1"}},
+		},
+	}
+	for _, logs := range cases {
+		expected, err := SpanLogJSON(traceId, spanId, logs)
+		assert.Nil(t, err)
+
+		var buf bytes.Buffer
+		assert.Nil(t, WriteSpanLogJSON(&buf, traceId, spanId, logs))
+		assert.Equal(t, expected, buf.String())
+	}
+}
+
+func TestSourceLength(t *testing.T) {
+	traceId := "7b3bf470-9456-11e8-9eb6-529269fb1459"
+	hgs := map[histogram.Granularity]bool{histogram.MINUTE: true}
+	longSource := strings.Repeat("s", 129)
+
+	_, err := MetricLine("foo.metric", 1.2, 1533529977, strings.Repeat("s", 128), nil, "")
+	assert.Nil(t, err)
+	_, err = MetricLine("foo.metric", 1.2, 1533529977, longSource, nil, "")
+	assert.NotNil(t, err)
+	_, err = MetricLine("foo.metric", 1.2, 1533529977, "", nil, longSource)
+	assert.NotNil(t, err)
+	_, err = HistoLine("request.latency", makeCentroids(), hgs, 1533529977, longSource, nil, "")
+	assert.NotNil(t, err)
+	_, err = SpanLine("order.shirts", 1533531013, 343500, longSource, traceId, traceId, nil, nil, nil, nil, "")
+	assert.NotNil(t, err)
+
+	// surrounding whitespace is trimmed before measuring
+	_, err = MetricLine("foo.metric", 1.2, 1533529977, " "+strings.Repeat("s", 128)+" ", nil, "")
+	assert.Nil(t, err)
+
+	// escaped quotes count once
+	_, err = MetricLine("foo.metric", 1.2, 1533529977, strings.Repeat(`"`, 100), nil, "")
+	assert.Nil(t, err)
+	_, err = MetricLine("foo.metric", 1.2, 1533529977, strings.Repeat(`"`, 129), nil, "")
+	assertFormatError(t, err, "source", "source exceeds the maximum length of 128 characters: 129")
+
+	_, err = MetricLine("foo.metric", 1.2, 1533529977, longSource, nil, "", MaxSourceLength(0))
+	assert.Nil(t, err)
+	_, err = MetricLine("foo.metric", 1.2, 1533529977, "test_source", nil, "", MaxSourceLength(5))
+	assert.NotNil(t, err)
+	_, err = HistoLine("request.latency", makeCentroids(), hgs, 1533529977, "test_source", nil, "", MaxSourceLength(5))
+	assert.NotNil(t, err)
+	_, err = SpanLine("order.shirts", 1533531013, 343500, "test_source", traceId, traceId, nil, nil, nil, nil, "", MaxSourceLength(5))
+	assert.NotNil(t, err)
+}
+
+func TestEventLineOrder(t *testing.T) {
+	tags := map[string]string{"env": "test", "app": "shop", "region": "us-west"}
+	expected := "@Event 1533531013000 1533531073000 \"deploy\" details=\"v1.2\" severity=\"info\" type=\"release\"" +
+		" host=\"test_source\" tag=\"app: shop\" tag=\"env: test\" tag=\"region: us-west\"\n"
+	for i := 0; i < 20; i++ {
+		line, err := EventLine("deploy", 1533531013, 1533531073, "test_source", tags,
+			event.Type("release"), event.Severity("info"), event.Details("v1.2"))
+		assert.Nil(t, err)
+		assert.Equal(t, expected, line)
+	}
+
+	line, err := EventLineJSON("deploy", 1533531013, 1533531073, "", tags)
+	assert.Nil(t, err)
+	assert.Contains(t, line, `"tags":["app: shop","env: test","region: us-west"]`)
+}
+
+func TestEventLineStructuredTags(t *testing.T) {
+	tags := map[string]string{"env": "prod: eu", "app": "shop", `a:b\c`: "v"}
+	line, err := EventLine("deploy", 1533531013, 1533531073, "test_source", tags, event.StructuredTags())
+	assert.Nil(t, err)
+	assert.Equal(t, `@Event 1533531013000 1533531073000 "deploy" host="test_source" tag="a\\:b\\\\c: v" tag="app: shop" tag="env: prod: eu"`+"\n", line)
+
+	line, err = EventLineJSON("deploy", 1533531013, 1533531073, "", tags, event.StructuredTags())
+	assert.Nil(t, err)
+	assert.Equal(t, `{"annotations":{},"endTime":1533531073000,"name":"deploy","startTime":1533531013000,"tags":["a\\:b\\\\c: v","app: shop","env: prod: eu"]}`, line)
+
+	var parsed struct{ Tags []string }
+	assert.Nil(t, json.Unmarshal([]byte(line), &parsed))
+	split := map[string]string{}
+	for _, tag := range parsed.Tags {
+		k, v, ok := SplitEventTag(tag)
+		assert.True(t, ok, tag)
+		split[k] = v
+	}
+	assert.Equal(t, tags, split)
+
+	line, err = EventLineJSON("deploy", 1533531013, 1533531073, "", nil, event.StructuredTags())
+	assert.Nil(t, err)
+	assert.NotContains(t, line, event.StructuredTagsKey)
+}
+
+func TestSplitEventTag(t *testing.T) {
+	for _, tag := range []string{"", "env", "env:prod", `env\: prod`} {
+		_, _, ok := SplitEventTag(tag)
+		assert.False(t, ok, tag)
+	}
+	key, value, ok := SplitEventTag("env: ")
+	assert.True(t, ok)
+	assert.Equal(t, "env", key)
+	assert.Equal(t, "", value)
+}
+
+func TestEventLineMillis(t *testing.T) {
+	line, err := EventLineMillis("deploy", 1000, 5000, "", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "@Event 1000 5000 \"deploy\"\n", line)
+
+	line, err = EventLineMillis("deploy", 1000, 0, "", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "@Event 1000 1001 \"deploy\"\n", line)
+
+	line, err = EventLine("deploy", 1000, 5000, "", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "@Event 1000000 5000000 \"deploy\"\n", line)
+
+	line, err = EventLine("deploy", 1533531013, 0, "", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "@Event 1533531013000 1533531013001 \"deploy\"\n", line)
+
+	line, err = EventLineJSONMillis("deploy", 1000, 0, "", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, `{"annotations":{},"endTime":1001,"name":"deploy","startTime":1000}`, line)
+
+	line, err = EventLineJSON("deploy", 1000, 0, "", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, `{"annotations":{},"endTime":1000001,"name":"deploy","startTime":1000000}`, line)
+}
+
+func TestEventLinesJSON(t *testing.T) {
+	events := []EventSpec{
+		{Name: "deploy", StartMillis: 1533531013, EndMillis: 1533531073, Source: "test_source",
+			Tags: map[string]string{"env": "test"}, Options: []event.Option{event.Severity(event.SeverityInfo)}},
+		{Name: "restart", StartMillis: 1000},
+	}
+	first, err := EventLineJSON(events[0].Name, events[0].StartMillis, events[0].EndMillis, events[0].Source, events[0].Tags, events[0].Options...)
+	assert.Nil(t, err)
+	second, err := EventLineJSON("restart", 1000, 0, "", nil)
+	assert.Nil(t, err)
+
+	line, err := EventLinesJSON(events)
+	assert.Nil(t, err)
+	assert.Equal(t, "["+first+","+second+"]", line)
+
+	line, err = EventLinesJSON(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "[]", line)
+
+	_, err = EventLinesJSON([]EventSpec{{Name: "deploy", StartMillis: 1000, Options: []event.Option{event.Severity("warning")}}})
+	assertFormatError(t, err, "annotations", `invalid event severity "warning", expected info, warn or severe`)
+}
+
+func TestLineTokens(t *testing.T) {
+	assert.Equal(t, " source=", sourceToken)
+	assert.Equal(t, " followsFrom=", followsFromToken)
+
+	line, err := EventLine("deploy", 1533531013, 0, "test_source", map[string]string{"env": "test"})
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(line, EventPrefix+" "))
+	assert.Contains(t, line, " "+EventHostKey+`="test_source"`)
+	assert.Contains(t, line, " "+EventTagKey+`="env: test"`)
+
+	traceId := "7b3bf470-9456-11e8-9eb6-529269fb1459"
+	line, err = SpanLine("order.shirts", 1533531013, 343500, "test_source", traceId, traceId, []string{traceId}, []string{traceId}, nil, nil, "")
+	assert.Nil(t, err)
+	for _, key := range []string{SourceKey, TraceIdKey, SpanIdKey, ParentKey, FollowsFromKey} {
+		assert.Contains(t, line, " "+key+"=")
+	}
+}
+
+func TestValidateEventAnnotations(t *testing.T) {
+	assert.Nil(t, ValidateEventAnnotations())
+	assert.Nil(t, ValidateEventAnnotations(event.Severity("info"), event.Type("release"), event.Annotate("foo", "")))
+	assert.Nil(t, ValidateEventAnnotations(event.Severity("warn")))
+	assert.Nil(t, ValidateEventAnnotations(event.Severity("severe")))
+	assert.NotNil(t, ValidateEventAnnotations(event.Severity("warning")))
+
+	_, err := EventLine("deploy", 1533531013, 0, "", nil, event.Severity("warning"))
+	assertFormatError(t, err, "annotations", `invalid event severity "warning", expected info, warn or severe`)
+	_, err = EventLineJSON("deploy", 1533531013, 0, "", nil, event.Annotate("severity", "Warn"))
+	assert.NotNil(t, err)
+	line, err := EventLine("deploy", 1533531013, 0, "", nil, event.Severity(event.SeverityWarn))
+	assert.Nil(t, err)
+	assert.Contains(t, line, ` severity="warn"`)
+	// only the severity is enforced when formatting
+	_, err = EventLine("deploy", 1533531013, 0, "", nil, event.Type(" "))
+	assert.Nil(t, err)
+	assert.NotNil(t, ValidateEventAnnotations(event.Type(" ")))
+}
+
+func TestWriteSpanLogJSONContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var buf bytes.Buffer
+	err := WriteSpanLogJSONContext(ctx, &buf, "7b3bf470-9456-11e8-9eb6-529269fb1459", "0313bafe-9457-11e8-9eb6-529269fb1459",
+		[]SpanLog{{Timestamp: 1533531013, Fields: map[string]string{"event": "start"}}})
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestOmitEmptySource(t *testing.T) {
+	traceId := "7b3bf470-9456-11e8-9eb6-529269fb1459"
+
+	line, err := MetricLine("foo.metric", 1.2, 1533529977, "", map[string]string{"env": "test"}, "")
+	assert.Nil(t, err)
+	assert.Equal(t, "\"foo.metric\" 1.2 1533529977 source=\"\" \"env\"=\"test\"\n", line)
+
+	line, err = MetricLine("foo.metric", 1.2, 1533529977, "", map[string]string{"env": "test"}, "", OmitEmptySource())
+	assert.Nil(t, err)
+	assert.Equal(t, "\"foo.metric\" 1.2 1533529977 \"env\"=\"test\"\n", line)
+
+	line, err = MetricLine("foo.metric", 1.2, 1533529977, "", nil, "default", OmitEmptySource())
+	assert.Nil(t, err)
+	assert.Equal(t, "\"foo.metric\" 1.2 1533529977 source=\"default\"\n", line)
+
+	line, err = HistoLine("request.latency", makeCentroids(), map[histogram.Granularity]bool{histogram.MINUTE: true},
+		1533529977, "", nil, "", OmitEmptySource())
+	assert.Nil(t, err)
+	assert.Equal(t, "!M 1533529977 #20 30 \"request.latency\"\n", line)
+
+	line, err = SpanLine("order.shirts", 1533531013, 343500, "", traceId, traceId, nil, nil, nil, nil, "", OmitEmptySource())
+	assert.Nil(t, err)
+	assert.Equal(t, "\"order.shirts\" traceId="+traceId+" spanId="+traceId+" 1533531013 343500\n", line)
+}
+
+func TestRejectNewlines(t *testing.T) {
+	traceId := "7b3bf470-9456-11e8-9eb6-529269fb1459"
+	hgs := map[histogram.Granularity]bool{histogram.MINUTE: true}
+
+	line, err := MetricLine("foo\nmetric", 1.2, 1533529977, "test_source", nil, "")
+	assert.Nil(t, err)
+	assert.Equal(t, "\"foo-metric\" 1.2 1533529977 source=\"test_source\"\n", line)
+
+	_, err = MetricLine("foo\nmetric", 1.2, 1533529977, "test_source", nil, "", RejectNewlines())
+	assert.EqualError(t, err, "name contains a newline: \"foo\\nmetric\"")
+	_, err = MetricLine("foo.metric", 1.2, 1533529977, "", nil, "test\nsource", RejectNewlines())
+	assert.NotNil(t, err)
+	_, err = MetricLine("foo.metric", 1.2, 1533529977, "test_source", map[string]string{"e\rnv": "test"}, "", RejectNewlines())
+	assert.NotNil(t, err)
+	_, err = HistoLine("request\nlatency", makeCentroids(), hgs, 1533529977, "test_source", nil, "", RejectNewlines())
+	assert.NotNil(t, err)
+	_, err = SpanLine("order.shirts", 1533531013, 343500, "test_source", traceId, traceId, nil, nil,
+		[]SpanTag{{Key: "e\nnv", Value: "test"}}, nil, "", RejectNewlines())
+	assert.NotNil(t, err)
+
+	// newlines in values are escaped, not rejected
+	_, err = MetricLine("foo.metric", 1.2, 1533529977, "test_source", map[string]string{"env": "te\nst"}, "", RejectNewlines())
+	assert.Nil(t, err)
+}
+
+func TestMetricLineTags(t *testing.T) {
+	tags := TagList{{Key: "env", Value: "test"}, {Key: "app", Value: "shop"}}
+	line, err := MetricLineTags("foo.metric", 1.2, 1533529977, "test_source", tags, "")
+	assert.Nil(t, err)
+	assert.Equal(t, "\"foo.metric\" 1.2 1533529977 source=\"test_source\" \"env\"=\"test\" \"app\"=\"shop\"\n", line)
+
+	line, err = MetricLineTags("foo.metric", 1.2, 1533529977, "test_source", TagList(nil), "")
+	assert.Nil(t, err)
+	assert.Equal(t, "\"foo.metric\" 1.2 1533529977 source=\"test_source\"\n", line)
+
+	_, err = MetricLineTags("foo.metric", 1.2, 1533529977, "test_source", TagList{{Key: "env", Value: ""}}, "")
+	assert.Equal(t, errBlankMetricTag, err)
+	_, err = MetricLineTags("foo.metric", 1.2, 1533529977, "test_source", TagList{{Key: "e\nnv", Value: "test"}}, "", RejectNewlines())
+	assert.NotNil(t, err)
+
+	allocs := testing.AllocsPerRun(100, func() {
+		MetricLineTags("foo.metric", 1.2, 1533529977, "test_source", &tags, "")
+	})
+	// the line config and the returned line, nothing per tag
+	assert.True(t, allocs <= 2, "allocs: %v", allocs)
+}
+
+func TestBoolSpanTags(t *testing.T) {
+	traceId := "7b3bf470-9456-11e8-9eb6-529269fb1459"
+	assert.Equal(t, SpanTag{Key: "error", Value: "true"}, BoolSpanTag("error", true))
+	assert.Equal(t, SpanTag{Key: "sampled", Value: "false"}, BoolSpanTag("sampled", false))
+
+	line, err := SpanLine("order.shirts", 1533531013, 343500, "test_source", traceId, traceId, nil, nil,
+		[]SpanTag{{Key: "error", Value: "True"}}, nil, "")
+	assert.Nil(t, err)
+	assert.Contains(t, line, " \"error\"=\"true\" ")
+
+	line, err = SpanLine("order.shirts", 1533531013, 343500, "test_source", traceId, traceId, nil, nil,
+		[]SpanTag{{Key: "debug", Value: "0"}, {Key: "error", Value: "maybe"}, {Key: "user", Value: "True"}}, nil, "")
+	assert.Nil(t, err)
+	assert.Contains(t, line, " \"debug\"=\"false\" \"error\"=\"maybe\" \"user\"=\"True\" ")
+}
+
+func TestMaxLineLength(t *testing.T) {
+	traceId := "7b3bf470-9456-11e8-9eb6-529269fb1459"
+	hgs := map[histogram.Granularity]bool{histogram.MINUTE: true, histogram.HOUR: true}
+
+	line, err := MetricLine("foo.metric", 1.2, 1533529977, "test_source", nil, "")
+	assert.Nil(t, err)
+	n := len(line) - 1
+	_, err = MetricLine("foo.metric", 1.2, 1533529977, "test_source", nil, "", MaxLineLength(n))
+	assert.Nil(t, err)
+	_, err = MetricLine("foo.metric", 1.2, 1533529977, "test_source", nil, "", MaxLineLength(n-1))
+	assert.EqualError(t, err, "line exceeds the maximum length of "+strconv.Itoa(n-1)+" bytes: "+strconv.Itoa(n))
+
+	dst := []byte("prefix\n")
+	out, err := MetricLineInto(dst, "foo.metric", 1.2, 1533529977, "test_source", nil, "", MaxLineLength(n))
+	assert.Nil(t, err)
+	assert.Equal(t, "prefix\n"+line, string(out))
+
+	line, err = HistoLine("request.latency", makeCentroids(), hgs, 1533529977, "test_source", nil, "")
+	assert.Nil(t, err)
+	n = strings.Index(line, "\n")
+	_, err = HistoLine("request.latency", makeCentroids(), hgs, 1533529977, "test_source", nil, "", MaxLineLength(n))
+	assert.Nil(t, err)
+	_, err = HistoLine("request.latency", makeCentroids(), hgs, 1533529977, "test_source", nil, "", MaxLineLength(n-1))
+	assert.NotNil(t, err)
+
+	line, err = SpanLine("order.shirts", 1533531013, 343500, "test_source", traceId, traceId, nil, nil, nil, nil, "")
+	assert.Nil(t, err)
+	_, err = SpanLine("order.shirts", 1533531013, 343500, "test_source", traceId, traceId, nil, nil, nil, nil, "", MaxLineLength(len(line)-2))
+	assert.NotNil(t, err)
+}
+
+func TestRawTraceId(t *testing.T) {
+	spanId := "0313bafe-9457-11e8-9eb6-529269fb1459"
+	id := [16]byte{0x7b, 0x3b, 0xf4, 0x70, 0x94, 0x56, 0x11, 0xe8, 0x9e, 0xb6, 0x52, 0x92, 0x69, 0xfb, 0x14, 0x59}
+
+	line, err := SpanLine("order.shirts", 1533531013, 343500, "test_source", "", spanId, nil, nil, nil, nil, "", RawTraceId(id))
+	assert.Nil(t, err)
+	assert.Equal(t, "\"order.shirts\" source=\"test_source\" traceId=7b3bf470-9456-11e8-9eb6-529269fb1459 spanId=0313bafe-9457-11e8-9eb6-529269fb1459 1533531013 343500\n", line)
+
+	tags := []SpanTag{{Key: "application", Value: "Wavefront"}, {Key: "zone", Value: "us"}}
+	line, err = SpanLine("order.shirts", 1533531013, 343500, "test_source", "", spanId, nil, nil, tags, nil, "", RawTraceId(id), TraceIdTags())
+	assert.Nil(t, err)
+	assert.Equal(t, "\"order.shirts\" source=\"test_source\" traceId=7b3bf470-9456-11e8-9eb6-529269fb1459 spanId=0313bafe-9457-11e8-9eb6-529269fb1459 "+
+		"\"application\"=\"Wavefront\" \"traceId.hi\"=\"7b3bf470945611e8\" \"traceId.lo\"=\"9eb6529269fb1459\" \"zone\"=\"us\" 1533531013 343500\n", line)
+	assert.Len(t, tags, 2)
+
+	line, err = SpanLine("order.shirts", 1533531013, 343500, "test_source", "7B3BF470945611E89EB6529269FB1459", spanId, nil, nil, nil, nil, "", TraceIdTags())
+	assert.Nil(t, err)
+	assert.Contains(t, line, " \"traceId.hi\"=\"7b3bf470945611e8\" \"traceId.lo\"=\"9eb6529269fb1459\" ")
+}
+
+func TestFormatError(t *testing.T) {
+	traceId := "7b3bf470-9456-11e8-9eb6-529269fb1459"
+	hgs := map[histogram.Granularity]bool{histogram.MINUTE: true}
+
+	_, err := MetricLine("", 1.2, 1533529977, "test_source", nil, "")
+	assertFormatError(t, err, "name", "empty metric name")
+	_, err = MetricLine("foo.metric", math.NaN(), 1533529977, "test_source", nil, "")
+	assertFormatError(t, err, "value", "metric value is NaN")
+	_, err = MetricLine("foo.metric", 1.2, 1533529977, "test_source", map[string]string{"env": ""}, "")
+	assertFormatError(t, err, "tags", "metric point tag value cannot be blank")
+	_, err = HistoLine("request.latency", histogram.Centroids{{Value: 1, Count: -1}}, hgs, 1533529977, "test_source", nil, "")
+	assertFormatError(t, err, "centroids", "centroid 0 has a negative count: -1")
+	_, err = HistoLine("request.latency", histogram.Centroids{{Value: 1, Count: 2}, {Value: 3, Count: 0}}, hgs, 1533529977, "test_source", nil, "")
+	assertFormatError(t, err, "centroids", "centroid 1 has a zero count")
+	_, err = SpanLine("order.shirts", 1533531013, 343500, "test_source", "123", traceId, nil, nil, nil, nil, "")
+	assertFormatError(t, err, "traceId", "traceId is not in UUID format")
+	err = ValidateEventAnnotations(event.Severity("fatal"))
+	assertFormatError(t, err, "annotations", `invalid event severity "fatal", expected info, warn or severe`)
+}
+
+func assertFormatError(t *testing.T, err error, field, reason string) {
+	var formatErr *FormatError
+	if assert.True(t, errors.As(err, &formatErr), "%v", err) {
+		assert.Equal(t, field, formatErr.Field)
+		assert.Equal(t, reason, formatErr.Reason)
+		assert.EqualError(t, err, reason)
+	}
+}
+
+func TestSanitizeTags(t *testing.T) {
+	raw := map[string]string{"env name": " te\"st ", "app": "shop\nfront"}
+	tags, err := SanitizeTags(raw)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, tags.Len())
+
+	expected, err := MetricLine("foo.metric", 1.2, 1533529977, "test_source", raw, "")
+	assert.Nil(t, err)
+	line, err := MetricLineSanitizedTags("foo.metric", 1.2, 1533529977, "test_source", tags, "")
+	assert.Nil(t, err)
+	assert.Equal(t, expected, line)
+
+	// tags not built by SanitizeTags cannot be passed, the zero value has no tags
+	line, err = MetricLineSanitizedTags("foo.metric", 1.2, 1533529977, "test_source", SanitizedTags{}, "")
+	assert.Nil(t, err)
+	assert.Equal(t, "\"foo.metric\" 1.2 1533529977 source=\"test_source\"\n", line)
+
+	_, err = SanitizeTags(map[string]string{"env": " "})
+	assert.Equal(t, errBlankMetricTag, err)
+	_, err = SanitizeTags(map[string]string{"": "test"})
+	assert.Equal(t, errBlankMetricTagKey, err)
+	_, err = SanitizeTags(map[string]string{"env name": "a", "env-name": "b"})
+	assertFormatError(t, err, "tags", err.Error())
+}
+
+func TestInternalMetricName(t *testing.T) {
+	for name, expected := range map[string]string{
+		"sdk.metrics.sent":  "~sdk.metrics.sent",
+		"~sdk.metrics.sent": "~sdk.metrics.sent",
+		"∆~weird":           "∆~weird",
+		"∆weird":            "∆~weird",
+		"Δweird":            "Δ~weird",
+		"Δ~weird":           "Δ~weird",
+		"":                  "~",
+	} {
+		internalName := InternalMetricName(name)
+		assert.Equal(t, expected, internalName, name)
+		// the sanitizer keeps the prefixes
+		assert.Equal(t, expected, SanitizeName(internalName), name)
+	}
+
+	line, err := DeltaCounterLine(InternalMetricName("sdk.metrics.sent"), 1, 0, "test_source", nil, "")
+	assert.Nil(t, err)
+	assert.Equal(t, "\"∆~sdk.metrics.sent\" 1 source=\"test_source\"\n", line)
+}
+
+func TestHistoLineSpacing(t *testing.T) {
+	centroids := histogram.Centroids{{Value: 30, Count: 20}}
+	hgs := map[histogram.Granularity]bool{histogram.MINUTE: true, histogram.DAY: true}
+
+	line, err := HistoLine("request.latency", centroids, hgs, 1533529977, "test_source", map[string]string{"env": "test"}, "")
+	assert.Nil(t, err)
+	assert.Equal(t, "!M 1533529977 #20 30 \"request.latency\" source=\"test_source\" \"env\"=\"test\"\n"+
+		"!D 1533529977 #20 30 \"request.latency\" source=\"test_source\" \"env\"=\"test\"\n", line)
+
+	line, err = HistoLine("request.latency", centroids, hgs, 0, "test_source", nil, "")
+	assert.Nil(t, err)
+	assert.Equal(t, "!M #20 30 \"request.latency\" source=\"test_source\"\n"+
+		"!D #20 30 \"request.latency\" source=\"test_source\"\n", line)
+
+	line, err = HistoLine("request.latency", centroids, hgs, 0, "", nil, "", OmitEmptySource(), QuoteNameIfNeeded())
+	assert.Nil(t, err)
+	assert.Equal(t, "!M #20 30 request.latency\n!D #20 30 request.latency\n", line)
+}
+
+func TestMaxSpanTags(t *testing.T) {
+	traceId := "7b3bf470-9456-11e8-9eb6-529269fb1459"
+	tags := []SpanTag{{Key: "z", Value: "1"}, {Key: "a", Value: "2"}, {Key: "m", Value: "3"}}
+
+	_, err := SpanLine("order.shirts", 1533531013, 343500, "test_source", traceId, traceId, nil, nil, tags, nil, "", MaxSpanTags(3))
+	assert.Nil(t, err)
+	_, err = SpanLine("order.shirts", 1533531013, 343500, "test_source", traceId, traceId, nil, nil, tags, nil, "", MaxSpanTags(2))
+	assertFormatError(t, err, "tags", "span has 3 tags, more than the maximum of 2")
+
+	line, err := SpanLine("order.shirts", 1533531013, 343500, "test_source", traceId, traceId, nil, nil, tags, nil, "", TruncateSpanTags(2))
+	assert.Nil(t, err)
+	assert.Equal(t, "\"order.shirts\" source=\"test_source\" traceId="+traceId+" spanId="+traceId+
+		" \"_truncatedTags\"=\"1\" \"a\"=\"2\" \"z\"=\"1\" 1533531013 343500\n", line)
+	assert.Len(t, tags, 3)
+
+	// the trace id tags count against the limit
+	_, err = SpanLine("order.shirts", 1533531013, 343500, "test_source", traceId, traceId, nil, nil, tags, nil, "", MaxSpanTags(4), TraceIdTags())
+	assertFormatError(t, err, "tags", "span has 5 tags, more than the maximum of 4")
+	line, err = SpanLine("order.shirts", 1533531013, 343500, "test_source", traceId, traceId, nil, nil, tags, nil, "", TruncateSpanTags(3), TraceIdTags())
+	assert.Nil(t, err)
+	assert.Equal(t, "\"order.shirts\" source=\"test_source\" traceId="+traceId+" spanId="+traceId+
+		" \"_truncatedTags\"=\"2\" \"traceId.hi\"=\"7b3bf470945611e8\" \"traceId.lo\"=\"9eb6529269fb1459\" \"z\"=\"1\" 1533531013 343500\n", line)
+}
+
+func TestMetricLineRaw(t *testing.T) {
+	for _, value := range []string{"0.1", "-12", "+3.", ".5", "12345678901234567890.000000000000000001"} {
+		line, err := MetricLineRaw("foo.metric", value, 1533529977, "test_source", nil, "")
+		assert.Nil(t, err)
+		assert.Equal(t, "\"foo.metric\" "+value+" 1533529977 source=\"test_source\"\n", line)
+	}
+	for _, value := range []string{"", "NaN", "Inf", "-", ".", "1e10", "0x10", "1.2.3", "1_000", " 1"} {
+		_, err := MetricLineRaw("foo.metric", value, 1533529977, "test_source", nil, "")
+		assertFormatError(t, err, "value", err.Error())
+	}
+}
+
+func TestHistoLineFromBody(t *testing.T) {
+	hgs := map[histogram.Granularity]bool{histogram.MINUTE: true, histogram.DAY: true}
+	tags := map[string]string{"env": "test"}
+
+	body, err := HistoBody("request.latency", makeCentroids(), 1533529977, "test_source", tags, "")
+	assert.Nil(t, err)
+	assert.False(t, strings.HasSuffix(body, "\n"))
+
+	expected, err := HistoLine("request.latency", makeCentroids(), hgs, 1533529977, "test_source", tags, "")
+	assert.Nil(t, err)
+	for i := 0; i < 2; i++ {
+		line, err := HistoLineFromBody(body, hgs)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, line)
+	}
+
+	line, err := HistoLineFromBody(body, map[histogram.Granularity]bool{histogram.HOUR: true})
+	assert.Nil(t, err)
+	assert.Equal(t, "!H"+body+"\n", line)
+
+	_, err = HistoLineFromBody(body, nil)
+	assertFormatError(t, err, "granularities", "histogram granularities cannot be empty")
+	_, err = HistoLineFromBody(body, hgs, MaxLineLength(len(body)))
+	assert.NotNil(t, err)
+	for _, invalid := range []string{"", "request.latency", body + "\n"} {
+		_, err = HistoLineFromBody(invalid, hgs)
+		assertFormatError(t, err, "body", err.Error())
+	}
+	_, err = HistoBody("", makeCentroids(), 1533529977, "test_source", nil, "")
+	assert.NotNil(t, err)
+}
+
+func TestNegativeTimestamp(t *testing.T) {
+	traceId := "7b3bf470-9456-11e8-9eb6-529269fb1459"
+	hgs := map[histogram.Granularity]bool{histogram.MINUTE: true}
+
+	_, err := MetricLine("foo.metric", 1.2, -1, "test_source", nil, "")
+	assertFormatError(t, err, "timestamp", "timestamp cannot be negative: -1")
+	_, err = HistoLine("request.latency", makeCentroids(), hgs, -1533529977, "test_source", nil, "")
+	assertFormatError(t, err, "timestamp", "timestamp cannot be negative: -1533529977")
+	_, err = SpanLine("order.shirts", -1, 343500, "test_source", traceId, traceId, nil, nil, nil, nil, "")
+	assertFormatError(t, err, "startMillis", "span start time cannot be negative")
+
+	// zero still leaves the timestamp to the server
+	line, err := MetricLine("foo.metric", 1.2, 0, "test_source", nil, "")
+	assert.Nil(t, err)
+	assert.Equal(t, "\"foo.metric\" 1.2 source=\"test_source\"\n", line)
+	_, err = HistoLine("request.latency", makeCentroids(), hgs, 0, "test_source", nil, "")
+	assert.Nil(t, err)
+}
+
+func TestFloatFormat(t *testing.T) {
+	hgs := map[histogram.Granularity]bool{histogram.MINUTE: true}
+
+	line, err := MetricLine("foo.metric", 1e21, 0, "test_source", nil, "")
+	assert.Nil(t, err)
+	assert.Equal(t, "\"foo.metric\" 1000000000000000000000 source=\"test_source\"\n", line)
+
+	line, err = MetricLine("foo.metric", 1e21, 0, "test_source", nil, "", FloatFormat('g'))
+	assert.Nil(t, err)
+	assert.Equal(t, "\"foo.metric\" 1e+21 source=\"test_source\"\n", line)
+
+	line, err = MetricLine("foo.metric", 0.25, 0, "test_source", nil, "", FloatFormat('g'))
+	assert.Nil(t, err)
+	assert.Equal(t, "\"foo.metric\" 0.25 source=\"test_source\"\n", line)
+
+	line, err = HistoLine("request.latency", histogram.Centroids{{Value: 1e-9, Count: 2}}, hgs, 0, "test_source", nil, "", FloatFormat('e'))
+	assert.Nil(t, err)
+	assert.Equal(t, "!M #2 1e-09 \"request.latency\" source=\"test_source\"\n", line)
+
+	for _, format := range []byte{'x', 'b', 'G', 0} {
+		_, err = MetricLine("foo.metric", 1, 0, "test_source", nil, "", FloatFormat(format))
+		assertFormatError(t, err, "value", err.Error())
+		_, err = HistoLine("request.latency", makeCentroids(), hgs, 0, "test_source", nil, "", FloatFormat(format))
+		assert.NotNil(t, err)
+	}
+}
+
+func TestMergeTags(t *testing.T) {
+	common := map[string]string{"env": "prod", "region": "us-west"}
+	point := map[string]string{"env": "test", "host": "a"}
+
+	merged := MergeTags(common, point)
+	assert.Equal(t, map[string]string{"env": "test", "region": "us-west", "host": "a"}, merged)
+	assert.Equal(t, map[string]string{"env": "prod", "region": "us-west"}, common)
+	assert.Equal(t, map[string]string{"env": "test", "host": "a"}, point)
+	assert.Equal(t, map[string]string{}, MergeTags(nil, nil))
+
+	expected, err := MetricLine("foo.metric", 1.2, 1533529977, "test_source", merged, "")
+	assert.Nil(t, err)
+	line, err := MetricLineCommonTags("foo.metric", 1.2, 1533529977, "test_source", common, point, "")
+	assert.Nil(t, err)
+	assert.Equal(t, expected, line)
+
+	line, err = MetricLineCommonTags("foo.metric", 1.2, 1533529977, "test_source", map[string]string{"env": "prod"}, nil, "")
+	assert.Nil(t, err)
+	assert.Equal(t, "\"foo.metric\" 1.2 1533529977 source=\"test_source\" \"env\"=\"prod\"\n", line)
+	line, err = MetricLineCommonTags("foo.metric", 1.2, 1533529977, "test_source", nil, nil, "")
+	assert.Nil(t, err)
+	assert.Equal(t, "\"foo.metric\" 1.2 1533529977 source=\"test_source\"\n", line)
+}
+
+func TestCentroidSignificantDigits(t *testing.T) {
+	hgs := map[histogram.Granularity]bool{histogram.MINUTE: true}
+	centroids := histogram.Centroids{{Value: 10.01, Count: 1}, {Value: 9.996, Count: 2}, {Value: 0.012345, Count: 3}}
+
+	line, err := HistoLine("request.latency", centroids, hgs, 0, "test_source", nil, "")
+	assert.Nil(t, err)
+	assert.Equal(t, "!M #3 0.012345 #2 9.996 #1 10.01 \"request.latency\" source=\"test_source\"\n", line)
+
+	line, err = HistoLine("request.latency", centroids, hgs, 0, "test_source", nil, "", CentroidSignificantDigits(3))
+	assert.Nil(t, err)
+	assert.Equal(t, "!M #3 0.0123 #3 10 \"request.latency\" source=\"test_source\"\n", line)
+	assert.Equal(t, 10.01, centroids[0].Value, "the centroids are not modified")
+}
+
+func TestSpanLineWithDefaults(t *testing.T) {
+	traceId := "7b3bf470-9456-11e8-9eb6-529269fb1459"
+	defaults := SpanDefaults{
+		Source: "default_source",
+		Tags:   map[string]string{"application": "shop", "service": "cart", "cluster": "us-west"},
+	}
+	tags := []SpanTag{{Key: "service", Value: "checkout"}, {Key: "user", Value: "a"}, {Key: "user", Value: "b"}}
+
+	line, err := SpanLineWithDefaults("order.shirts", 1533531013, 343500, "", traceId, traceId, nil, nil, tags, nil, defaults)
+	assert.Nil(t, err)
+	assert.Equal(t, "\"order.shirts\" source=\"default_source\" traceId="+traceId+" spanId="+traceId+
+		" \"application\"=\"shop\" \"cluster\"=\"us-west\" \"service\"=\"checkout\" \"user\"=\"a\" \"user\"=\"b\" 1533531013 343500\n", line)
+	assert.Len(t, tags, 3)
+
+	line, err = SpanLineWithDefaults("order.shirts", 1533531013, 343500, "test_source", traceId, traceId, nil, nil, nil, nil, SpanDefaults{})
+	assert.Nil(t, err)
+	assert.Equal(t, "\"order.shirts\" source=\"test_source\" traceId="+traceId+" spanId="+traceId+" 1533531013 343500\n", line)
+}
+
+func TestMetricLineSize(t *testing.T) {
+	cases := []struct {
+		name   string
+		value  float64
+		source string
+		tags   map[string]string
+	}{
+		{"foo.metric", 1.2, "test_source", nil},
+		{"∆foo metric", -1.2345678901234567e-5, " host ", map[string]string{"env": "te\"st\n", "path": `C:\tmp`}},
+		{"foo", math.MaxInt64, "", map[string]string{"a": "b", "c": "d"}},
+		{"foo", math.MaxFloat64, "", nil},
+		{"foo", -1e21, "", nil},
+		{"foo", -math.SmallestNonzeroFloat64, "", nil},
+		{"foo", 1.2345678901234567e-5, "", nil},
+		{"foo", 0, "", nil},
+	}
+	for _, c := range cases {
+		line, err := MetricLine(c.name, c.value, math.MaxInt64, c.source, c.tags, "")
+		assert.Nil(t, err)
+		size := MetricLineSize(c.name, c.value, c.source, c.tags)
+		assert.True(t, size >= len(line), "%d < %d: %s", size, len(line), line)
+		assert.True(t, size <= len(line)+maxValueSize, "%d is not close to %d: %s", size, len(line), line)
+	}
+}
+
+func TestSpanTagsBuilder(t *testing.T) {
+	traceId := "7b3bf470-9456-11e8-9eb6-529269fb1459"
+	var tags SpanTags
+	assert.Equal(t, []SpanTag{}, tags.Build())
+
+	tags.Set("service", "cart")
+	tags.Set("application", "shop")
+	tags.Set("service", "checkout")
+	assert.Equal(t, 2, tags.Len())
+	built := tags.Build()
+	assert.Equal(t, []SpanTag{{Key: "application", Value: "shop"}, {Key: "service", Value: "checkout"}}, built)
+
+	tags.Set("error", "true")
+	assert.Len(t, built, 2, "built tags are not changed by later calls to Set")
+
+	line, err := SpanLine("order.shirts", 1533531013, 343500, "test_source", traceId, traceId, nil, nil, tags.Build(), nil, "")
+	assert.Nil(t, err)
+	assert.Contains(t, line, ` "application"="shop" "error"="true" "service"="checkout" `)
+}
+
+func TestRejectEqualsInTagKeys(t *testing.T) {
+	traceId := "7b3bf470-9456-11e8-9eb6-529269fb1459"
+	hgs := map[histogram.Granularity]bool{histogram.MINUTE: true}
+	tags := map[string]string{"http.status=code": "200"}
+
+	line, err := MetricLine("foo.metric", 1, 0, "test_source", tags, "")
+	assert.Nil(t, err)
+	assert.Equal(t, "\"foo.metric\" 1 source=\"test_source\" \"http.status-code\"=\"200\"\n", line)
+
+	_, err = MetricLine("foo.metric", 1, 0, "test_source", tags, "", RejectEqualsInTagKeys())
+	assertFormatError(t, err, "tags", `tag key "http.status=code" contains the reserved character '='`)
+	_, err = HistoLine("request.latency", makeCentroids(), hgs, 0, "test_source", tags, "", RejectEqualsInTagKeys())
+	assert.NotNil(t, err)
+	_, err = SpanLine("order.shirts", 1533531013, 343500, "test_source", traceId, traceId, nil, nil,
+		[]SpanTag{{Key: "a=b", Value: "c"}}, nil, "", RejectEqualsInTagKeys())
+	assert.NotNil(t, err)
+
+	// values may contain '='
+	_, err = MetricLine("foo.metric", 1, 0, "test_source", map[string]string{"query": "a=b"}, "", RejectEqualsInTagKeys())
+	assert.Nil(t, err)
+}
+
 func makeCentroids() []histogram.Centroid {
 	centroids := []histogram.Centroid{
 		{
@@ -230,4 +2009,19 @@ func TestVerifyUUID(tt *testing.T) {
 			t.Fail()
 		}
 	})
+	tt.Run("Good hyphenless UUID", func(t *testing.T) {
+		if isUUIDFormat("00112233445566778899AABBccddeeff") == false {
+			t.Fail()
+		}
+	})
+	tt.Run("Bad hyphenless UUID 1", func(t *testing.T) {
+		if isUUIDFormat("0011223344556677889-aabbccddeeff") == true {
+			t.Fail()
+		}
+	})
+	tt.Run("Bad hyphenless UUID 2", func(t *testing.T) {
+		if isUUIDFormat("0011223344556677") == true {
+			t.Fail()
+		}
+	})
 }
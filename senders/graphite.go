@@ -0,0 +1,52 @@
+package senders
+
+import (
+	"math"
+	"strconv"
+
+	"github.com/wavefronthq/wavefront-sdk-go/internal"
+)
+
+// GraphiteLine gets a metric line in the Graphite plaintext format:
+// <path> <value> <timestamp>
+// Example: "new-york.power.usage 42422 1533531013"
+// Graphite requires a timestamp. The dots of the path separate its nodes and are kept,
+// any character but a-z, A-Z, 0-9, '-', '_' and '.', such as a space, is replaced with '_'.
+func GraphiteLine(path string, value float64, ts int64) (string, error) {
+	if path == "" {
+		return "", newFormatError("name", "empty metric path")
+	}
+	if math.IsNaN(value) {
+		return "", newFormatError("value", "metric value is NaN")
+	}
+	if math.IsInf(value, 0) {
+		return "", newFormatError("value", "metric value is infinite")
+	}
+	if ts <= 0 {
+		return "", newFormatError("timestamp", "Graphite requires a positive timestamp: %d", ts)
+	}
+
+	sb := internal.GetBuffer()
+	defer internal.PutBuffer(sb)
+
+	sb.Grow(len(path) + 48)
+	sanitizeGraphite(sb, path)
+	sb.WriteByte(' ')
+	sb.SetBuf(appendValue(sb.GetBuf(), value, 'f'))
+	sb.WriteByte(' ')
+	sb.SetBuf(strconv.AppendInt(sb.GetBuf(), ts, 10))
+	sb.WriteByte('\n')
+	return string(sb.GetBuf()), nil
+}
+
+// sanitizeGraphite writes path with every character Graphite does not allow in a node
+// replaced with '_'.
+func sanitizeGraphite(sb *internal.StringBuilder, path string) {
+	for i := 0; i < len(path); i++ {
+		if c := path[i]; c != ',' && c != '/' && isLegalNameByte(c) {
+			sb.WriteByte(c)
+		} else {
+			sb.WriteByte('_')
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package senders
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGraphiteLine(t *testing.T) {
+	line, err := GraphiteLine("new-york.power.usage", 42422, 1533531013)
+	assert.Nil(t, err)
+	assert.Equal(t, "new-york.power.usage 42422 1533531013\n", line)
+
+	line, err = GraphiteLine("servers.web 1.cpu/user", 0.25, 1533531013)
+	assert.Nil(t, err)
+	assert.Equal(t, "servers.web_1.cpu_user 0.25 1533531013\n", line)
+}
+
+func TestGraphiteLineErrors(t *testing.T) {
+	_, err := GraphiteLine("", 1, 1533531013)
+	assertFormatError(t, err, "name", "empty metric path")
+	_, err = GraphiteLine("m", math.Inf(1), 1533531013)
+	assertFormatError(t, err, "value", "metric value is infinite")
+	_, err = GraphiteLine("m", 1, -1)
+	assertFormatError(t, err, "timestamp", "Graphite requires a positive timestamp: -1")
+}
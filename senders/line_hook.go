@@ -0,0 +1,49 @@
+package senders
+
+// LineKind is the data format of a line passed to OnLineFormatted.
+type LineKind int
+
+const (
+	LineKindMetric LineKind = iota
+	LineKindHistogram
+	LineKindSpan
+	LineKindEvent
+)
+
+func (k LineKind) String() string {
+	switch k {
+	case LineKindMetric:
+		return "metric"
+	case LineKindHistogram:
+		return "histogram"
+	case LineKindSpan:
+		return "span"
+	case LineKindEvent:
+		return "event"
+	}
+	return "unknown"
+}
+
+// OnLineFormatted, when set, is called with every line successfully formatted by MetricLine,
+// HistoLine, SpanLine, EventLine, their variants, LineWriter and MetricBatch, for instance to
+// log or sample outgoing lines. The line includes its trailing newline; for a distribution it
+// holds one line per granularity. The hook is called synchronously, from the goroutine that
+// formats the line, and must be safe for concurrent use. Like SetSanitizeReplacement it should
+// be set once during initialization. Nothing is done when it is nil.
+var OnLineFormatted func(kind LineKind, line string)
+
+// formatted passes a formatted line to OnLineFormatted and returns it.
+func formatted(kind LineKind, line string) string {
+	if hook := OnLineFormatted; hook != nil {
+		hook(kind, line)
+	}
+	return line
+}
+
+// observeLine passes the line formatted at buf[start:] to OnLineFormatted. The line is only
+// copied when the hook is set.
+func observeLine(kind LineKind, buf []byte, start int) {
+	if hook := OnLineFormatted; hook != nil {
+		hook(kind, string(buf[start:]))
+	}
+}
@@ -0,0 +1,84 @@
+package senders
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wavefronthq/wavefront-sdk-go/histogram"
+)
+
+func TestOnLineFormatted(t *testing.T) {
+	var kinds []LineKind
+	var lines []string
+	OnLineFormatted = func(kind LineKind, line string) {
+		kinds = append(kinds, kind)
+		lines = append(lines, line)
+	}
+	defer func() { OnLineFormatted = nil }()
+
+	metric, err := MetricLine("new-york.power.usage", 42422, 1533531013, "localhost", nil, "")
+	assert.Nil(t, err)
+	histo, err := HistoLine("request.latency", makeCentroids(), map[histogram.Granularity]bool{histogram.MINUTE: true}, 1533531013, "appServer1", nil, "")
+	assert.Nil(t, err)
+	traceId := "7b3bf470-9456-11e8-9eb6-529269fb1459"
+	span, err := SpanLine("order.shirts", 1533531013, 343500, "test_source", traceId, traceId, nil, nil, nil, nil, "")
+	assert.Nil(t, err)
+	event, err := EventLine("deploy", 1533531013, 1533531014, "localhost", nil)
+	assert.Nil(t, err)
+	into, err := MetricLineInto([]byte("prefix\n"), "new-york.power.usage", 42422, 1533531013, "localhost", nil, "")
+	assert.Nil(t, err)
+
+	_, err = MetricLine("", 1, 0, "localhost", nil, "")
+	assert.NotNil(t, err)
+
+	assert.Equal(t, []LineKind{LineKindMetric, LineKindHistogram, LineKindSpan, LineKindEvent, LineKindMetric}, kinds)
+	assert.Equal(t, []string{metric, histo, span, event, string(into[len("prefix\n"):])}, lines)
+	assert.Equal(t, "histogram", LineKindHistogram.String())
+}
+
+func TestOnLineFormattedWriters(t *testing.T) {
+	var lines []string
+	OnLineFormatted = func(kind LineKind, line string) {
+		lines = append(lines, line)
+	}
+	defer func() { OnLineFormatted = nil }()
+
+	batch := NewMetricBatch("localhost")
+	assert.Nil(t, batch.Add("a", 1, 1533531013, "", nil))
+	assert.Nil(t, batch.Add("b", 2, 1533531013, "", nil))
+	assert.Equal(t, string(batch.Bytes()), lines[0]+lines[1])
+}
+
+func TestOnLineFormattedWriteHistoLines(t *testing.T) {
+	var lines []string
+	OnLineFormatted = func(kind LineKind, line string) {
+		lines = append(lines, line)
+	}
+	defer func() { OnLineFormatted = nil }()
+
+	hgs := map[histogram.Granularity]bool{histogram.MINUTE: true}
+	perSource := map[string]histogram.Centroids{
+		"web1": {{Value: 1, Count: 2}},
+		"web2": {{Value: 3, Count: 4}},
+	}
+	var out bytes.Buffer
+	assert.Nil(t, WriteHistoLines(&out, "request.latency", perSource, hgs, 1533531013, nil, ""))
+	assert.Len(t, lines, 2)
+	assert.Equal(t, out.String(), lines[0]+lines[1])
+
+	// nothing is observed when the source lines are not written
+	lines = nil
+	perSource["web3"] = nil
+	assert.NotNil(t, WriteHistoLines(&out, "request.latency", perSource, hgs, 1533531013, nil, ""))
+	delete(perSource, "web3")
+	assert.NotNil(t, WriteHistoLines(failingWriter{}, "request.latency", perSource, hgs, 1533531013, nil, ""))
+	assert.Empty(t, lines)
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("write failed")
+}
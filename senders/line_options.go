@@ -0,0 +1,269 @@
+package senders
+
+const defaultMaxSourceLength = 128
+
+// LineOption configures the validation and formatting of a single line.
+type LineOption func(*lineConfig)
+
+type lineConfig struct {
+	maxSourceLength      int
+	quoteNameIfNeeded    bool
+	spanLogsMarker       *bool
+	dropBlankTags        bool
+	omitEmptySource      bool
+	rejectNewlines       bool
+	maxLineLength        int
+	rawTraceId           *[16]byte
+	traceIdTags          bool
+	maxSpanTags          int
+	truncateSpanTags     bool
+	floatFormat          byte
+	centroidDigits       int
+	rejectEqualsInKeys   bool
+	histoExtremes        *[2]float64
+	serverTimestamp      bool
+	generateSpanId       bool
+	metricType           MetricType
+	warnOnZeroValue      bool
+	maxPointTags         int
+	truncatePointTags    bool
+	quoteStyle           QuoteStyle
+	normalizeDeltaPrefix bool
+	// preSanitizedName is set by MetricLinePreSanitized, it has no option
+	preSanitizedName bool
+}
+
+// defaultLineConfig is shared by all lines formatted without options. It must not be modified.
+var defaultLineConfig = lineConfig{
+	maxSourceLength: defaultMaxSourceLength,
+	floatFormat:     'f',
+}
+
+func newLineConfig(setters []LineOption) *lineConfig {
+	if len(setters) == 0 {
+		return &defaultLineConfig
+	}
+	cfg := &lineConfig{
+		maxSourceLength: defaultMaxSourceLength,
+		floatFormat:     'f',
+	}
+	for _, setter := range setters {
+		setter(cfg)
+	}
+	return cfg
+}
+
+// MaxSourceLength sets the maximum number of characters of the trimmed source, counted
+// before quotes are escaped.
+// Lines with a longer source are rejected, as the proxy would drop them. Defaults to 128,
+// a value of 0 disables the check.
+func MaxSourceLength(n int) LineOption {
+	return func(cfg *lineConfig) {
+		cfg.maxSourceLength = n
+	}
+}
+
+// QuoteNameIfNeeded writes metric and distribution names without quotes when the sanitized
+// name only contains ASCII letters, digits, '.', '-', '_' and an optional leading '~'.
+// By default names are always quoted.
+func QuoteNameIfNeeded() LineOption {
+	return func(cfg *lineConfig) {
+		cfg.quoteNameIfNeeded = true
+	}
+}
+
+// SpanLogsMarker sets whether span lines carry the SpanLogsTagKey marker. By default the
+// marker is written when span logs are passed to the formatter.
+func SpanLogsMarker(emit bool) LineOption {
+	return func(cfg *lineConfig) {
+		cfg.spanLogsMarker = &emit
+	}
+}
+
+// DropBlankTags skips tags with an empty key or a value that is blank once trimmed,
+// instead of rejecting the whole line. By default such tags are an error.
+func DropBlankTags() LineOption {
+	return func(cfg *lineConfig) {
+		cfg.dropBlankTags = true
+	}
+}
+
+// OmitEmptySource leaves out the source token when both the source and the default source
+// are empty, so the proxy infers the source from the connection. By default an empty
+// source is written as source="".
+func OmitEmptySource() LineOption {
+	return func(cfg *lineConfig) {
+		cfg.omitEmptySource = true
+	}
+}
+
+// RejectNewlines makes a newline in a name, source or tag key an error. It usually means
+// unrelated text ended up in the name. By default newlines are silently replaced.
+func RejectNewlines() LineOption {
+	return func(cfg *lineConfig) {
+		cfg.rejectNewlines = true
+	}
+}
+
+// MaxLineLength sets the maximum length in bytes of a formatted line, excluding the trailing
+// newline. Longer lines are rejected instead of having the proxy drop the whole batch they
+// are sent in. By default the length is not limited.
+func MaxLineLength(n int) LineOption {
+	return func(cfg *lineConfig) {
+		cfg.maxLineLength = n
+	}
+}
+
+// RawTraceId sets the trace id of a span from its 16 raw bytes, which are written in the
+// canonical UUID form. It takes precedence over the traceId passed to SpanLine.
+func RawTraceId(id [16]byte) LineOption {
+	return func(cfg *lineConfig) {
+		cfg.rawTraceId = &id
+	}
+}
+
+// TraceIdTags adds the high and low 64 bits of the trace id as the span tags traceId.hi
+// and traceId.lo, each as 16 lowercase hex digits, for correlating with systems that
+// store 128-bit trace ids as two halves. The two tags count against MaxSpanTags and
+// TruncateSpanTags, which keep them ahead of the caller's tags.
+func TraceIdTags() LineOption {
+	return func(cfg *lineConfig) {
+		cfg.traceIdTags = true
+	}
+}
+
+// MaxSpanTags rejects spans with more than n tags. By default the number of tags is not limited.
+func MaxSpanTags(n int) LineOption {
+	return func(cfg *lineConfig) {
+		cfg.maxSpanTags = n
+		cfg.truncateSpanTags = false
+	}
+}
+
+// TruncateSpanTags keeps the first n tags of spans with more than n tags and drops the rest,
+// adding the number of dropped tags as the _truncatedTags span tag.
+func TruncateSpanTags(n int) LineOption {
+	return func(cfg *lineConfig) {
+		cfg.maxSpanTags = n
+		cfg.truncateSpanTags = true
+	}
+}
+
+// FloatFormat sets the strconv format of metric and centroid values: 'f' for plain decimals,
+// the default, or 'g' and 'e' to use exponents for values spanning many orders of magnitude,
+// such as 1e+21 instead of 1000000000000000000000. Other formats are rejected when formatting.
+func FloatFormat(format byte) LineOption {
+	return func(cfg *lineConfig) {
+		cfg.floatFormat = format
+	}
+}
+
+// CentroidSignificantDigits rounds centroid values to n significant digits before centroids
+// with equal values are merged, so near-identical values share a centroid. This trades the
+// precision of the distribution for shorter histogram lines. By default, or when n is 0,
+// values are not rounded.
+func CentroidSignificantDigits(n int) LineOption {
+	return func(cfg *lineConfig) {
+		cfg.centroidDigits = n
+	}
+}
+
+// RejectEqualsInTagKeys makes a tag key containing '=', such as "http.status=code", an error.
+// It usually means a key and value were passed together as the key. By default the '=' is
+// silently replaced like any other character not allowed in tag keys.
+func RejectEqualsInTagKeys() LineOption {
+	return func(cfg *lineConfig) {
+		cfg.rejectEqualsInKeys = true
+	}
+}
+
+// HistogramExtremes adds the observed minimum and maximum of a distribution as the
+// centroids #1 <min> and #1 <max>, first and last on histogram lines, so tail queries see
+// the true extremes rather than the approximation of the summary. They count as one point
+// each, so callers keeping the total count exact should leave these two points out of the
+// centroids. The sentinels are written after the centroids are compacted, and are not
+// rounded by CentroidSignificantDigits, so they are never merged into a centroid with the
+// same value. The extremes must be finite and bound all centroid values.
+func HistogramExtremes(min, max float64) LineOption {
+	return func(cfg *lineConfig) {
+		cfg.histoExtremes = &[2]float64{min, max}
+	}
+}
+
+// ServerTimestamp omits the timestamp of metric and histogram lines, whatever ts is passed,
+// so the server assigns the time the line is received. It states explicitly what a zero ts
+// does implicitly, which keeps working.
+func ServerTimestamp() LineOption {
+	return func(cfg *lineConfig) {
+		cfg.serverTimestamp = true
+	}
+}
+
+// GenerateSpanId makes SpanLine use a new random id, see NewSpanID, for a span passed with an
+// empty span id. The id is not returned, so it only suits spans that have no child spans
+// referring to them; otherwise call NewSpanID and pass the id. By default an empty span id
+// is an error.
+func GenerateSpanId() LineOption {
+	return func(cfg *lineConfig) {
+		cfg.generateSpanId = true
+	}
+}
+
+// MetricTypeTag adds the type of metric points as the _type tag, gauge, counter or delta, for
+// tooling that tells them apart. The delta type also prefixes the name with ∆ like
+// DeltaCounterLine, so a delta counter is marked the same way by both, while a name with the
+// delta prefix is rejected for the other types. A point tag with the _type key is rejected.
+// By default no type tag is written.
+func MetricTypeTag(t MetricType) LineOption {
+	return func(cfg *lineConfig) {
+		cfg.metricType = t
+	}
+}
+
+// WarnOnZeroValue makes ValidateMetric warn about a value of exactly 0, which is often an
+// uninitialized value rather than a measurement, to audit metrics that are always zero.
+// The line is formatted as usual; formatters without warnings ignore this option.
+func WarnOnZeroValue() LineOption {
+	return func(cfg *lineConfig) {
+		cfg.warnOnZeroValue = true
+	}
+}
+
+// MaxPointTags rejects metric points and distributions with more than n point tags, blank tags
+// included, as a guardrail against runaway cardinality. By default the number of tags is not
+// limited.
+func MaxPointTags(n int) LineOption {
+	return func(cfg *lineConfig) {
+		cfg.maxPointTags = n
+		cfg.truncatePointTags = false
+	}
+}
+
+// TruncatePointTags keeps the first n point tags of metric points and distributions with more
+// than n tags and drops the rest. Tags from a map are ordered by sanitized key, so the same
+// tags are always kept; tags from a TagSource are kept in the order of the source.
+func TruncatePointTags(n int) LineOption {
+	return func(cfg *lineConfig) {
+		cfg.maxPointTags = n
+		cfg.truncatePointTags = true
+	}
+}
+
+// QuoteEscaping sets how double quotes are escaped in tag values, sources and span names, for
+// proxies expecting quotes doubled with QuoteDoubled. Backslashes and control characters are
+// escaped with a backslash in either style. UnsanitizeValue and the line parser only read the
+// default style, QuoteBackslash.
+func QuoteEscaping(style QuoteStyle) LineOption {
+	return func(cfg *lineConfig) {
+		cfg.quoteStyle = style
+	}
+}
+
+// NormalizeDeltaPrefix writes the Δ (U+0394) prefix of metric and distribution names as ∆
+// (U+2206), the prefix added by DeltaCounterLine, so a delta counter is reported under one
+// name whichever prefix its producers use. By default the prefix is kept as given.
+func NormalizeDeltaPrefix() LineOption {
+	return func(cfg *lineConfig) {
+		cfg.normalizeDeltaPrefix = true
+	}
+}
@@ -0,0 +1,86 @@
+package senders
+
+import (
+	"context"
+	"io"
+
+	"github.com/wavefronthq/wavefront-sdk-go/histogram"
+	"github.com/wavefronthq/wavefront-sdk-go/internal"
+)
+
+// LineWriter formats metrics, distributions and spans into one buffer, in the order they are
+// written, until they are flushed together. The buffer is kept across flushes, so batches of
+// any size reuse its memory.
+// A LineWriter must not be copied after first use and is not safe for concurrent use.
+type LineWriter struct {
+	sb            internal.StringBuilder
+	defaultSource string
+	cfg           *lineConfig
+}
+
+// NewLineWriter creates an empty writer. defaultSource is used for lines written without a source.
+func NewLineWriter(defaultSource string, setters ...LineOption) *LineWriter {
+	return &LineWriter{
+		defaultSource: defaultSource,
+		cfg:           newLineConfig(setters),
+	}
+}
+
+// WriteMetric formats a metric point like MetricLine and appends it to the buffer.
+// An invalid point returns an error and leaves the buffered lines untouched.
+func (lw *LineWriter) WriteMetric(name string, value float64, ts int64, source string, tags map[string]string) error {
+	sb := &lw.sb
+	n := sb.Len()
+	scratch := getTagScratch()
+	defer putTagScratch(scratch)
+	if err := writeMetricLine(sb, name, value, "", ts, source, scratch.mapTags(nil, tags), lw.defaultSource, lw.cfg); err != nil {
+		sb.SetBuf(sb.GetBuf()[:n])
+		return err
+	}
+	observeLine(LineKindMetric, sb.GetBuf(), n)
+	return nil
+}
+
+// WriteHisto formats a distribution like HistoLine and appends its lines to the buffer.
+// An invalid distribution returns an error and leaves the buffered lines untouched.
+func (lw *LineWriter) WriteHisto(name string, centroids histogram.Centroids, hgs map[histogram.Granularity]bool, ts int64, source string, tags map[string]string) error {
+	sb := &lw.sb
+	n := sb.Len()
+	scratch := getTagScratch()
+	defer putTagScratch(scratch)
+	if err := writeHistoLine(context.Background(), sb, name, centroids, enabledGranularities(hgs), ts, source, scratch.mapTags(nil, tags), lw.defaultSource, lw.cfg); err != nil {
+		sb.SetBuf(sb.GetBuf()[:n])
+		return err
+	}
+	observeLine(LineKindHistogram, sb.GetBuf(), n)
+	return nil
+}
+
+// WriteSpan formats a span like SpanLine and appends it to the buffer.
+// An invalid span returns an error and leaves the buffered lines untouched.
+func (lw *LineWriter) WriteSpan(name string, startMillis, durationMillis int64, source, traceId, spanId string, parents, followsFrom []string, tags []SpanTag, spanLogs []SpanLog) error {
+	sb := &lw.sb
+	n := sb.Len()
+	if err := writeSpanLine(sb, name, startMillis, durationMillis, source, traceId, spanId, parents, followsFrom, tags, spanLogs, lw.defaultSource, lw.cfg); err != nil {
+		sb.SetBuf(sb.GetBuf()[:n])
+		return err
+	}
+	observeLine(LineKindSpan, sb.GetBuf(), n)
+	return nil
+}
+
+// Len returns the number of buffered bytes.
+func (lw *LineWriter) Len() int {
+	return lw.sb.Len()
+}
+
+// Flush writes the buffered lines to w and empties the buffer, keeping it for reuse.
+// The buffer is emptied even if writing fails.
+func (lw *LineWriter) Flush(w io.Writer) error {
+	if lw.sb.Len() == 0 {
+		return nil
+	}
+	_, err := lw.sb.WriteTo(w)
+	lw.sb.Reset()
+	return err
+}
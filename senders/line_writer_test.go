@@ -0,0 +1,74 @@
+package senders
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wavefronthq/wavefront-sdk-go/histogram"
+)
+
+func TestLineWriter(t *testing.T) {
+	traceId := "7b3bf470-9456-11e8-9eb6-529269fb1459"
+	hgs := map[histogram.Granularity]bool{histogram.MINUTE: true}
+	lw := NewLineWriter("default")
+
+	var buf bytes.Buffer
+	assert.Nil(t, lw.Flush(&buf))
+	assert.Equal(t, 0, buf.Len())
+
+	assert.Nil(t, lw.WriteMetric("foo.metric", 1.2, 1533529977, "test_source", nil))
+	assert.Nil(t, lw.WriteSpan("order.shirts", 1533531013, 343500, "", traceId, traceId, nil, nil, nil, nil))
+	assert.NotNil(t, lw.WriteHisto("request.latency", nil, hgs, 1533529977, "test_source", nil))
+	assert.Nil(t, lw.WriteHisto("request.latency", histogram.Centroids{{Value: 30, Count: 20}}, hgs, 1533529977, "test_source", nil))
+	assert.NotNil(t, lw.WriteMetric("", 1, 0, "", nil))
+	assert.Nil(t, lw.WriteMetric("bar.metric", 3, 0, "", nil))
+
+	expected := "\"foo.metric\" 1.2 1533529977 source=\"test_source\"\n" +
+		"\"order.shirts\" source=\"default\" traceId=" + traceId + " spanId=" + traceId + " 1533531013 343500\n" +
+		"!M 1533529977 #20 30 \"request.latency\" source=\"test_source\"\n" +
+		"\"bar.metric\" 3 source=\"default\"\n"
+	assert.Equal(t, len(expected), lw.Len())
+	assert.Nil(t, lw.Flush(&buf))
+	assert.Equal(t, expected, buf.String())
+	assert.Equal(t, 0, lw.Len())
+
+	buf.Reset()
+	assert.Nil(t, lw.WriteMetric("baz.metric", 1, 0, "test_source", nil))
+	assert.Nil(t, lw.Flush(&buf))
+	assert.Equal(t, "\"baz.metric\" 1 source=\"test_source\"\n", buf.String())
+}
+
+func TestLineWriterKeepsBuffer(t *testing.T) {
+	lw := NewLineWriter("default")
+	for lw.Len() <= 64*1024 {
+		assert.Nil(t, lw.WriteMetric("foo.metric", 1.2, 1533529977, "test_source", nil))
+	}
+	capacity := lw.sb.Cap()
+	assert.Nil(t, lw.Flush(ioutil.Discard))
+	assert.Equal(t, 0, lw.Len())
+	assert.Equal(t, capacity, lw.sb.Cap())
+}
+
+// BenchmarkLineWriter flushes batches larger than the buffers kept by the pool.
+func BenchmarkLineWriter(b *testing.B) {
+	tags := map[string]string{"env": "test", "region": "us-west"}
+	names := make([]string, 1000)
+	for i := range names {
+		names[i] = "foo.metric." + strconv.Itoa(i)
+	}
+	lw := NewLineWriter("default")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, name := range names {
+			_ = lw.WriteMetric(name, 1.2, 1533529977, "test_source", tags)
+		}
+		if lw.Len() <= 64*1024 {
+			b.Fatalf("batch of %d bytes is not larger than 64 KB", lw.Len())
+		}
+		_ = lw.Flush(ioutil.Discard)
+	}
+}
@@ -0,0 +1,6 @@
+//go:build !race
+// +build !race
+
+package senders
+
+const raceEnabled = false
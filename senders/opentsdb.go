@@ -0,0 +1,87 @@
+package senders
+
+import (
+	"bytes"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/wavefronthq/wavefront-sdk-go/internal"
+)
+
+// OpenTSDBLine gets a metric line in the OpenTSDB telnet format:
+// put <metric> <timestamp> <value> <tagk1=tagv1 ...>
+// Example: "put new-york.power.usage 1533531013 42422 datacenter=dc1"
+// OpenTSDB requires a timestamp and at least one tag. Characters OpenTSDB does not allow in
+// names, tag keys and tag values, anything but a-z, A-Z, 0-9, '-', '_', '.' and '/', are
+// replaced with '-', and tag keys that are the same once replaced are an error. Tags are
+// written in the same order as by MetricLine.
+func OpenTSDBLine(name string, value float64, ts int64, tags map[string]string) (string, error) {
+	if name == "" {
+		return "", newFormatError("name", "empty metric name")
+	}
+	if math.IsNaN(value) {
+		return "", newFormatError("value", "metric value is NaN")
+	}
+	if math.IsInf(value, 0) {
+		return "", newFormatError("value", "metric value is infinite")
+	}
+	if ts <= 0 {
+		return "", newFormatError("timestamp", "OpenTSDB requires a positive timestamp: %d", ts)
+	}
+	if len(tags) == 0 {
+		return "", newFormatError("tags", "OpenTSDB requires at least one tag")
+	}
+
+	scratch := getTagScratch()
+	defer putTagScratch(scratch)
+	sorted := *scratch.mapTags(nil, tags)
+	for _, tag := range sorted {
+		if tag.key == "" {
+			return "", errBlankMetricTagKey
+		}
+		if strings.TrimSpace(tag.value) == "" {
+			return "", errBlankMetricTag
+		}
+	}
+
+	sb := internal.GetBuffer()
+	defer internal.PutBuffer(sb)
+
+	sb.WriteString("put ")
+	sanitizeOpenTSDB(sb, name)
+	sb.WriteByte(' ')
+	sb.SetBuf(strconv.AppendInt(sb.GetBuf(), ts, 10))
+	sb.WriteByte(' ')
+	sb.SetBuf(appendValue(sb.GetBuf(), value, 'f'))
+	// offsets of the written keys, to reject keys that are the same once sanitized
+	keys := make([][2]int, 0, len(sorted))
+	for i, tag := range sorted {
+		sb.WriteByte(' ')
+		start := sb.Len()
+		sanitizeOpenTSDB(sb, tag.key)
+		buf := sb.GetBuf()
+		for j, k := range keys {
+			if bytes.Equal(buf[k[0]:k[1]], buf[start:]) {
+				return "", newFormatError("tags", "tag keys %q and %q are the same once sanitized", sorted[j].key, sorted[i].key)
+			}
+		}
+		keys = append(keys, [2]int{start, len(buf)})
+		sb.WriteByte('=')
+		sanitizeOpenTSDB(sb, strings.TrimSpace(tag.value))
+	}
+	sb.WriteByte('\n')
+	return string(sb.GetBuf()), nil
+}
+
+// sanitizeOpenTSDB writes str with every character OpenTSDB does not allow replaced with '-'.
+// Unlike Wavefront names, ',' is not allowed.
+func sanitizeOpenTSDB(sb *internal.StringBuilder, str string) {
+	for i := 0; i < len(str); i++ {
+		if c := str[i]; c != ',' && isLegalNameByte(c) {
+			sb.WriteByte(c)
+		} else {
+			sb.WriteByte('-')
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package senders
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpenTSDBLine(t *testing.T) {
+	line, err := OpenTSDBLine("new-york.power.usage", 42422, 1533531013, map[string]string{"datacenter": "dc1", "az": "us-west-2"})
+	assert.Nil(t, err)
+	assert.Equal(t, "put new-york.power.usage 1533531013 42422 az=us-west-2 datacenter=dc1\n", line)
+
+	line, err = OpenTSDBLine("new york,power", 0.5, 1533531013, map[string]string{"host name": " web 1 "})
+	assert.Nil(t, err)
+	assert.Equal(t, "put new-york-power 1533531013 0.5 host-name=web-1\n", line)
+}
+
+func TestOpenTSDBLineErrors(t *testing.T) {
+	tags := map[string]string{"host": "web1"}
+
+	_, err := OpenTSDBLine("", 1, 1533531013, tags)
+	assertFormatError(t, err, "name", "empty metric name")
+	_, err = OpenTSDBLine("m", math.NaN(), 1533531013, tags)
+	assertFormatError(t, err, "value", "metric value is NaN")
+	_, err = OpenTSDBLine("m", 1, 0, tags)
+	assertFormatError(t, err, "timestamp", "OpenTSDB requires a positive timestamp: 0")
+	_, err = OpenTSDBLine("m", 1, 1533531013, nil)
+	assertFormatError(t, err, "tags", "OpenTSDB requires at least one tag")
+	_, err = OpenTSDBLine("m", 1, 1533531013, map[string]string{"host": " "})
+	assert.Equal(t, errBlankMetricTag, err)
+	_, err = OpenTSDBLine("m", 1, 1533531013, map[string]string{"a b": "1", "a-b": "2"})
+	assertFormatError(t, err, "tags", `tag keys "a b" and "a-b" are the same once sanitized`)
+	_, err = OpenTSDBLine("m", 1, 1533531013, map[string]string{"a,b": "1", "a-b": "2"})
+	assertFormatError(t, err, "tags", `tag keys "a,b" and "a-b" are the same once sanitized`)
+}
@@ -0,0 +1,143 @@
+package senders
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ParseMetricLine parses a line in the Wavefront metrics data format, as produced by MetricLine:
+// <metricName> <metricValue> [<timestamp>] source=<source> [pointTags]
+// Names, keys and values may be quoted, quoted strings may contain escaped quotes and newlines.
+// The timestamp is 0 when the line has none.
+func ParseMetricLine(line string) (name string, value float64, ts int64, source string, tags map[string]string, err error) {
+	p := lineParser{line: strings.TrimRight(line, "\r\n")}
+
+	if name, err = p.term(); err != nil {
+		return "", 0, 0, "", nil, err
+	}
+	if name == "" {
+		return "", 0, 0, "", nil, errors.New("invalid metric line: empty metric name")
+	}
+
+	p.skipSpaces()
+	rawValue, err := p.term()
+	if err != nil {
+		return "", 0, 0, "", nil, err
+	}
+	if value, err = strconv.ParseFloat(rawValue, 64); err != nil {
+		return "", 0, 0, "", nil, fmt.Errorf("invalid metric line: invalid value %q", rawValue)
+	}
+
+	sourceFound := false
+	for p.skipSpaces(); !p.done(); p.skipSpaces() {
+		key, err := p.term()
+		if err != nil {
+			return "", 0, 0, "", nil, err
+		}
+		if !p.consume('=') {
+			// the only token that is not a key/value pair is the timestamp following the value
+			if ts != 0 || sourceFound || len(tags) > 0 {
+				return "", 0, 0, "", nil, fmt.Errorf("invalid metric line: unexpected token %q", key)
+			}
+			if ts, err = strconv.ParseInt(key, 10, 64); err != nil {
+				return "", 0, 0, "", nil, fmt.Errorf("invalid metric line: invalid timestamp %q", key)
+			}
+			continue
+		}
+
+		val, err := p.term()
+		if err != nil {
+			return "", 0, 0, "", nil, err
+		}
+		if key == "" {
+			return "", 0, 0, "", nil, errors.New("invalid metric line: empty tag key")
+		}
+		if !sourceFound && key == SourceKey {
+			source = val
+			sourceFound = true
+			continue
+		}
+		if tags == nil {
+			tags = make(map[string]string)
+		}
+		tags[key] = val
+	}
+	return name, value, ts, source, tags, nil
+}
+
+// lineParser tokenizes a line of the Wavefront data format.
+type lineParser struct {
+	line string
+	pos  int
+}
+
+func (p *lineParser) done() bool {
+	return p.pos >= len(p.line)
+}
+
+func (p *lineParser) skipSpaces() {
+	for !p.done() && p.line[p.pos] == ' ' {
+		p.pos++
+	}
+}
+
+func (p *lineParser) consume(c byte) bool {
+	if !p.done() && p.line[p.pos] == c {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// term reads a quoted string or an unquoted run of characters up to a space or '='.
+func (p *lineParser) term() (string, error) {
+	if !p.consume('"') {
+		start := p.pos
+		for !p.done() && p.line[p.pos] != ' ' && p.line[p.pos] != '=' {
+			if p.line[p.pos] == '"' {
+				return "", fmt.Errorf("invalid line: unexpected quote at %d", p.pos)
+			}
+			p.pos++
+		}
+		return p.line[start:p.pos], nil
+	}
+
+	var sb strings.Builder
+	for !p.done() {
+		c := p.line[p.pos]
+		p.pos++
+		switch c {
+		case '"':
+			return sb.String(), nil
+		case '\\':
+			if p.done() {
+				sb.WriteByte(c)
+				continue
+			}
+			switch p.line[p.pos] {
+			case '"':
+				sb.WriteByte('"')
+				p.pos++
+			case 'n':
+				sb.WriteByte('\n')
+				p.pos++
+			case '\\':
+				sb.WriteByte('\\')
+				p.pos++
+			case 'r':
+				sb.WriteByte('\r')
+				p.pos++
+			case 't':
+				sb.WriteByte('\t')
+				p.pos++
+			default:
+				sb.WriteByte(c)
+			}
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return "", errors.New("invalid line: unterminated quoted string")
+}
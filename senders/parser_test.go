@@ -0,0 +1,82 @@
+package senders
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMetricLine(t *testing.T) {
+	name, value, ts, source, tags, err := ParseMetricLine(
+		"\"foo.metric\" 1.2 1533529977 source=\"test_source\" \"env\"=\"test\" \"msg\"=\"say \\\"hi\\\"\\nbye\"\n")
+	assert.Nil(t, err)
+	assert.Equal(t, "foo.metric", name)
+	assert.Equal(t, 1.2, value)
+	assert.Equal(t, int64(1533529977), ts)
+	assert.Equal(t, "test_source", source)
+	assert.Equal(t, map[string]string{"env": "test", "msg": "say \"hi\"\nbye"}, tags)
+
+	name, value, ts, source, tags, err = ParseMetricLine("foo.metric -3 source=localhost env=test")
+	assert.Nil(t, err)
+	assert.Equal(t, "foo.metric", name)
+	assert.Equal(t, float64(-3), value)
+	assert.Equal(t, int64(0), ts)
+	assert.Equal(t, "localhost", source)
+	assert.Equal(t, map[string]string{"env": "test"}, tags)
+}
+
+func TestParseMetricLineRoundTrip(t *testing.T) {
+	tags := map[string]string{"env": "test", "quote": "a \"b\" c", "multi": "line\nbreak", "region": "us-west",
+		"path": `C:\temp\x`, "regex": `^\d+\.\"\n$`}
+	line, err := MetricLine("∆foo.count", 42.5, 1533529977, "1.2.3.4:8080", tags, "")
+	assert.Nil(t, err)
+
+	name, value, ts, source, parsedTags, err := ParseMetricLine(line)
+	assert.Nil(t, err)
+	assert.Equal(t, "∆foo.count", name)
+	assert.Equal(t, 42.5, value)
+	assert.Equal(t, int64(1533529977), ts)
+	assert.Equal(t, "1.2.3.4:8080", source)
+	assert.Equal(t, tags, parsedTags)
+
+	line, err = MetricLine("foo.metric", 1, 0, "test_source", nil, "")
+	assert.Nil(t, err)
+	_, _, ts, _, parsedTags, err = ParseMetricLine(line)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), ts)
+	assert.Nil(t, parsedTags)
+}
+
+func TestControlCharactersRoundTrip(t *testing.T) {
+	for c := 0; c < 0x20; c++ {
+		value := "a" + string(rune(c)) + "b"
+		line, err := MetricLine("foo.metric", 1, 0, "test_source", map[string]string{"env": value}, "")
+		assert.Nil(t, err)
+		body := strings.TrimSuffix(line, "\n")
+		assert.NotContains(t, body, "\n", "control character %#x", c)
+		assert.NotContains(t, body, "\r", "control character %#x", c)
+		assert.NotContains(t, body, "\t", "control character %#x", c)
+
+		_, _, _, _, tags, err := ParseMetricLine(line)
+		assert.Nil(t, err)
+		assert.Equal(t, value, tags["env"], "control character %#x", c)
+	}
+}
+
+func TestParseMetricLineErrors(t *testing.T) {
+	for _, line := range []string{
+		"",
+		"\"\" 1 source=a",
+		"foo.metric",
+		"foo.metric abc source=a",
+		"foo.metric 1 1533529977 1533529977 source=a",
+		"foo.metric 1 source=a 1533529977",
+		"foo.metric 1 source=\"a",
+		"foo.metric 1 source=a =b",
+		"foo\"metric 1 source=a",
+	} {
+		_, _, _, _, _, err := ParseMetricLine(line)
+		assert.NotNil(t, err, line)
+	}
+}
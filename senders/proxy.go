@@ -232,6 +232,11 @@ func (sender *proxySender) SendSpan(name string, startMillis, durationMillis int
 		}
 	}
 
+	logs, err := spanLogsLine(traceId, spanId, spanLogs)
+	if err != nil {
+		sender.spanLogsInvalid.Inc()
+		return err
+	}
 	line, err := SpanLine(name, startMillis, durationMillis, source, traceId, spanId, parents, followsFrom, tags, spanLogs, sender.defaultSource)
 	if err != nil {
 		sender.spansInvalid.Inc()
@@ -246,14 +251,8 @@ func (sender *proxySender) SendSpan(name string, startMillis, durationMillis int
 		return err
 	}
 
-	if len(spanLogs) > 0 {
-		logs, err := SpanLogJSON(traceId, spanId, spanLogs)
-		if err != nil {
-			sender.spanLogsInvalid.Inc()
-			return err
-		} else {
-			sender.spanLogsValid.Inc()
-		}
+	if logs != "" {
+		sender.spanLogsValid.Inc()
 		err = handler.SendData(logs)
 		if err != nil {
 			sender.spanLogsDropped.Inc()
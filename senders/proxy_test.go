@@ -1,11 +1,14 @@
 package senders_test
 
 import (
+	"bufio"
 	"io"
 	"net"
 	"os"
 	"testing"
+	"time"
 
+	"github.com/stretchr/testify/assert"
 	"github.com/wavefronthq/wavefront-sdk-go/histogram"
 	"github.com/wavefronthq/wavefront-sdk-go/senders"
 )
@@ -64,7 +67,7 @@ func TestProxySends(t *testing.T) {
 		t.Error("Failed SendDistribution", err)
 	}
 
-	if err = proxy.SendSpan("getAllUsers", 0, 343500, "localhost",
+	if err = proxy.SendSpan("getAllUsers", 1533531013, 343500, "localhost",
 		"7b3bf470-9456-11e8-9eb6-529269fb1459", "0313bafe-9457-11e8-9eb6-529269fb1459",
 		[]string{"2f64e538-9457-11e8-9eb6-529269fb1459"}, nil,
 		[]senders.SpanTag{
@@ -81,3 +84,69 @@ func TestProxySends(t *testing.T) {
 		t.Error("FailureCount =", proxy.GetFailureCount())
 	}
 }
+
+// listenLines accepts a single connection and sends the lines read from it to the channel.
+func listenLines(t *testing.T) (int, <-chan string) {
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := make(chan string, 16)
+	go func() {
+		defer lis.Close()
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+	return lis.Addr().(*net.TCPAddr).Port, lines
+}
+
+func readLine(t *testing.T, lines <-chan string) string {
+	select {
+	case line := <-lines:
+		return line
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a line")
+		return ""
+	}
+}
+
+func TestProxySendSpanCanonicalIds(t *testing.T) {
+	port, lines := listenLines(t)
+	sender, err := senders.NewProxySender(&senders.ProxyConfiguration{Host: "localhost", TracingPort: port})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = sender.SendSpan("getAllUsers", 1533531013, 343500, "localhost",
+		"7B3BF470-9456-11E8-9EB6-529269FB1459", "0313BAFE-9457-11E8-9EB6-529269FB1459", nil, nil, nil,
+		[]senders.SpanLog{{Timestamp: 1533531013, Fields: map[string]string{"event": "error"}}})
+	assert.Nil(t, err)
+	sender.Flush()
+	defer sender.Close()
+
+	assert.Contains(t, readLine(t, lines), "traceId=7b3bf470-9456-11e8-9eb6-529269fb1459 spanId=0313bafe-9457-11e8-9eb6-529269fb1459")
+	assert.Contains(t, readLine(t, lines), `"traceId":"7b3bf470-9456-11e8-9eb6-529269fb1459","spanId":"0313bafe-9457-11e8-9eb6-529269fb1459"`)
+
+	// a span with invalid logs is not sent, the next line read is the following span
+	err = sender.SendSpan("invalidLogs", 1533531013, 343500, "localhost",
+		"7b3bf470-9456-11e8-9eb6-529269fb1459", "0313bafe-9457-11e8-9eb6-529269fb1459", nil, nil, nil,
+		[]senders.SpanLog{{Timestamp: 1533531013}})
+	assert.NotNil(t, err)
+
+	// ids as 32 hex characters are hyphenated in both lines
+	err = sender.SendSpan("getAllUsers", 1533531013, 343500, "localhost",
+		"7b3bf470945611e89eb6529269fb1459", "0313bafe945711e89eb6529269fb1459", nil, nil, nil,
+		[]senders.SpanLog{{Timestamp: 1533531013, Fields: map[string]string{"event": "error"}}})
+	assert.Nil(t, err)
+	sender.Flush()
+
+	assert.Contains(t, readLine(t, lines), "traceId=7b3bf470-9456-11e8-9eb6-529269fb1459 spanId=0313bafe-9457-11e8-9eb6-529269fb1459")
+	assert.Contains(t, readLine(t, lines), `"traceId":"7b3bf470-9456-11e8-9eb6-529269fb1459","spanId":"0313bafe-9457-11e8-9eb6-529269fb1459"`)
+}
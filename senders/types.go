@@ -1,6 +1,9 @@
 package senders
 
 import (
+	"sort"
+	"strconv"
+
 	"github.com/wavefronthq/wavefront-sdk-go/event"
 	"github.com/wavefronthq/wavefront-sdk-go/histogram"
 )
@@ -10,17 +13,156 @@ type SpanTag struct {
 	Value string
 }
 
+// BoolSpanTag returns a span tag with the value written as lowercase true or false.
+func BoolSpanTag(key string, v bool) SpanTag {
+	return SpanTag{Key: key, Value: strconv.FormatBool(v)}
+}
+
+// SpanTags builds span tags with one value per key, for tags assembled from several sources.
+// The zero value is ready to use.
+type SpanTags struct {
+	tags  []SpanTag
+	index map[string]int
+}
+
+// Set sets the value of a tag, replacing the value set before for the same key.
+func (t *SpanTags) Set(key, value string) {
+	if i, ok := t.index[key]; ok {
+		t.tags[i].Value = value
+		return
+	}
+	if t.index == nil {
+		t.index = make(map[string]int)
+	}
+	t.index[key] = len(t.tags)
+	t.tags = append(t.tags, SpanTag{Key: key, Value: value})
+}
+
+// Len returns the number of tags.
+func (t *SpanTags) Len() int {
+	return len(t.tags)
+}
+
+// Build returns the tags sorted by key, to be passed to SpanLine.
+func (t *SpanTags) Build() []SpanTag {
+	tags := make([]SpanTag, len(t.tags))
+	copy(tags, t.tags)
+	sort.Slice(tags, func(i, j int) bool {
+		return tags[i].Key < tags[j].Key
+	})
+	return tags
+}
+
+// SpanContext holds the ids of a span and its links, passed as one value to SpanLineCtx so
+// the trace id and span id cannot be swapped at the call site.
+type SpanContext struct {
+	TraceId     string
+	SpanId      string
+	Parents     []string
+	FollowsFrom []string
+}
+
+// MetricType is the kind of a metric point, written as the MetricTypeTagKey tag by the
+// MetricTypeTag option.
+type MetricType int
+
+const (
+	MetricTypeGauge MetricType = iota + 1
+	MetricTypeCounter
+	MetricTypeDelta
+)
+
+// MetricTypeTagKey is the point tag holding the type of a metric set with MetricTypeTag.
+const MetricTypeTagKey = "_type"
+
+func (t MetricType) String() string {
+	switch t {
+	case MetricTypeGauge:
+		return "gauge"
+	case MetricTypeCounter:
+		return "counter"
+	case MetricTypeDelta:
+		return "delta"
+	}
+	return "unknown"
+}
+
+// QuoteStyle is how double quotes in tag values, sources and span names are escaped.
+type QuoteStyle int
+
+const (
+	// QuoteBackslash escapes a quote with a backslash, \", as the Wavefront proxy expects.
+	QuoteBackslash QuoteStyle = iota
+	// QuoteDoubled escapes a quote by doubling it, "".
+	QuoteDoubled
+)
+
+// EventSpec is an event for EventLinesJSON, with the arguments of EventLineJSON.
+type EventSpec struct {
+	Name        string
+	StartMillis int64
+	// EndMillis is 0 for an instantaneous event
+	EndMillis int64
+	Source    string
+	Tags      map[string]string
+	Options   []event.Option
+}
+
+// TagSource provides point tags by index, so tags kept in a slice or any other
+// structure can be formatted without first copying them into a map.
+type TagSource interface {
+	Len() int
+	Tag(i int) (key, value string)
+}
+
+// TagList is a TagSource backed by a slice of key/value pairs.
+type TagList []SpanTag
+
+func (t TagList) Len() int {
+	return len(t)
+}
+
+func (t TagList) Tag(i int) (string, string) {
+	return t[i].Key, t[i].Value
+}
+
 type SpanLog struct {
 	Timestamp int64             `json:"timestamp"`
 	Fields    map[string]string `json:"fields"`
 }
 
+// NewSpanLog returns a span log checked like SpanLogs.Validate: ts must be positive and
+// fields must not be empty. The fields map is not copied.
+func NewSpanLog(ts int64, fields map[string]string) (SpanLog, error) {
+	if ts <= 0 {
+		return SpanLog{}, newFormatError("spanLogs", "span log has no positive timestamp: %d", ts)
+	}
+	if len(fields) == 0 {
+		return SpanLog{}, newFormatError("spanLogs", "span log has no fields")
+	}
+	return SpanLog{Timestamp: ts, Fields: fields}, nil
+}
+
 type SpanLogs struct {
 	TraceId string    `json:"traceId"`
 	SpanId  string    `json:"spanId"`
 	Logs    []SpanLog `json:"logs"`
 }
 
+// Validate checks that every log has a positive timestamp and at least one field,
+// as logs without them are rejected by the backend.
+func (l SpanLogs) Validate() error {
+	for i, log := range l.Logs {
+		if log.Timestamp <= 0 {
+			return newFormatError("spanLogs", "span log %d has no positive timestamp: %d", i, log.Timestamp)
+		}
+		if len(log.Fields) == 0 {
+			return newFormatError("spanLogs", "span log %d has no fields", i)
+		}
+	}
+	return nil
+}
+
 // MetricSender Interface for sending metrics to Wavefront
 type MetricSender interface {
 	// Sends a single metric to Wavefront with optional timestamp and tags.
@@ -0,0 +1,69 @@
+package senders
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/wavefronthq/wavefront-sdk-go/event"
+)
+
+// ValidateMetric formats a metric point like MetricLine without sending it and reports, next to
+// the line, the non-fatal changes made to the input: sanitized names and tag keys, trimmed
+// values, a defaulted source and dropped blank tags, as well as a zero value with the
+// WarnOnZeroValue option. It is meant for tests checking that metric definitions format cleanly.
+func ValidateMetric(name string, value float64, ts int64, source string, tags map[string]string, defaultSource string, setters ...LineOption) (string, []string, error) {
+	line, err := MetricLine(name, value, ts, source, tags, defaultSource, setters...)
+	if err != nil {
+		return "", nil, err
+	}
+	cfg := newLineConfig(setters)
+
+	var warnings []string
+	if cfg.warnOnZeroValue && value == 0 {
+		warnings = append(warnings, fmt.Sprintf("metric %q has a value of exactly 0", name))
+	}
+	if sanitized := sanitizeInternal(name); sanitized != name {
+		warnings = append(warnings, fmt.Sprintf("name %q was sanitized to %q", name, sanitized))
+	}
+	if source == "" {
+		warnings = append(warnings, fmt.Sprintf("source defaulted to %q", defaultSource))
+		source = defaultSource
+	}
+	if trimmed := strings.TrimSpace(source); trimmed != source {
+		warnings = append(warnings, fmt.Sprintf("source %q was trimmed to %q", source, trimmed))
+	}
+	for _, k := range sortedKeys(tags) {
+		v := tags[k]
+		if cfg.dropBlankTags && isBlankTag(k, v) {
+			warnings = append(warnings, fmt.Sprintf("blank tag %q=%q was dropped", k, v))
+			continue
+		}
+		if sanitized := sanitizeInternal(k); sanitized != k {
+			warnings = append(warnings, fmt.Sprintf("tag key %q was sanitized to %q", k, sanitized))
+		}
+		if trimmed := strings.TrimSpace(v); trimmed != v {
+			warnings = append(warnings, fmt.Sprintf("tag %q value %q was trimmed to %q", k, v, trimmed))
+		}
+	}
+	return line, warnings, nil
+}
+
+// ValidateEvent formats an event like EventLine and reports, next to the line, the times that
+// were taken as seconds and converted to milliseconds, which may be a unit bug. Use
+// EventLineStrict to reject such times when formatting.
+func ValidateEvent(name string, startMillis, endMillis int64, source string, tags map[string]string, setters ...event.Option) (string, []string, error) {
+	line, err := EventLine(name, startMillis, endMillis, source, tags, setters...)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var warnings []string
+	start, end := ambiguousEventTimes(startMillis, endMillis)
+	if start {
+		warnings = append(warnings, fmt.Sprintf("start time %d was taken as seconds and converted to milliseconds", startMillis))
+	}
+	if end {
+		warnings = append(warnings, fmt.Sprintf("end time %d was taken as seconds and converted to milliseconds", endMillis))
+	}
+	return line, warnings, nil
+}
@@ -0,0 +1,76 @@
+package senders
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wavefronthq/wavefront-sdk-go/event"
+)
+
+func TestValidateMetric(t *testing.T) {
+	line, warnings, err := ValidateMetric("foo.metric", 1.2, 1533529977, "test_source", map[string]string{"env": "test"}, "")
+	assert.Nil(t, err)
+	assert.Equal(t, "\"foo.metric\" 1.2 1533529977 source=\"test_source\" \"env\"=\"test\"\n", line)
+	assert.Empty(t, warnings)
+
+	line, warnings, err = ValidateMetric("foo metric", 1.2, 0, "", map[string]string{"env name": " test", "blank": " "}, " host ", DropBlankTags())
+	assert.Nil(t, err)
+	assert.Equal(t, "\"foo-metric\" 1.2 source=\"host\" \"env-name\"=\"test\"\n", line)
+	assert.Equal(t, []string{
+		`name "foo metric" was sanitized to "foo-metric"`,
+		`source defaulted to " host "`,
+		`source " host " was trimmed to "host"`,
+		`blank tag "blank"=" " was dropped`,
+		`tag key "env name" was sanitized to "env-name"`,
+		`tag "env name" value " test" was trimmed to "test"`,
+	}, warnings)
+
+	_, warnings, err = ValidateMetric("", 1.2, 0, "test_source", nil, "")
+	assertFormatError(t, err, "name", "empty metric name")
+	assert.Nil(t, warnings)
+}
+
+func TestValidateMetricZeroValue(t *testing.T) {
+	line, warnings, err := ValidateMetric("foo.metric", 0, 1533529977, "test_source", nil, "", WarnOnZeroValue())
+	assert.Nil(t, err)
+	assert.Equal(t, "\"foo.metric\" 0 1533529977 source=\"test_source\"\n", line)
+	assert.Equal(t, []string{`metric "foo.metric" has a value of exactly 0`}, warnings)
+
+	_, warnings, err = ValidateMetric("foo.metric", 0, 1533529977, "test_source", nil, "")
+	assert.Nil(t, err)
+	assert.Empty(t, warnings)
+
+	_, warnings, err = ValidateMetric("foo.metric", 1e-9, 1533529977, "test_source", nil, "", WarnOnZeroValue())
+	assert.Nil(t, err)
+	assert.Empty(t, warnings)
+}
+
+func TestValidateEvent(t *testing.T) {
+	line, warnings, err := ValidateEvent("deploy", 1533531013000, 0, "", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "@Event 1533531013000 1533531013001 \"deploy\"\n", line)
+	assert.Empty(t, warnings)
+
+	line, warnings, err = ValidateEvent("deploy", 1533531013, 5000, "", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "@Event 1533531013000 5000000 \"deploy\"\n", line)
+	assert.Equal(t, []string{
+		"start time 1533531013 was taken as seconds and converted to milliseconds",
+		"end time 5000 was taken as seconds and converted to milliseconds",
+	}, warnings)
+
+	_, warnings, err = ValidateEvent("deploy", 1533531013, 0, "", nil, event.Severity("warning"))
+	assert.NotNil(t, err)
+	assert.Nil(t, warnings)
+}
+
+func TestEventLineStrict(t *testing.T) {
+	line, err := EventLineStrict("deploy", 1533531013000, 0, "", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "@Event 1533531013000 1533531013001 \"deploy\"\n", line)
+
+	_, err = EventLineStrict("deploy", 1533531013, 0, "", nil)
+	assertFormatError(t, err, "startMillis", "event start time 1533531013 may be seconds or milliseconds")
+	_, err = EventLineStrict("deploy", 1533531013000, 1533531073, "", nil)
+	assertFormatError(t, err, "endMillis", "event end time 1533531073 may be seconds or milliseconds")
+}